@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// constants definitions of supported compressions of repository tarballs. zstd uses the zstd binary, which has to
+// be installed next to git.
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+// archiveExtensions maps file extensions of tarballs to their compression. Longer extensions go first.
+var archiveExtensions = []struct {
+	extension   string
+	compression string
+}{
+	{".tar.gz", COMPRESSION_GZIP},
+	{".tar.zst", COMPRESSION_ZSTD},
+	{".tar", COMPRESSION_NONE},
+}
+
+// validCompression will check that the compression is supported.
+func validCompression(compression string) bool {
+	for _, archive := range archiveExtensions {
+		if archive.compression == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveExtension will return the file extension of tarballs with given compression.
+func archiveExtension(compression string) string {
+	for _, archive := range archiveExtensions {
+		if archive.compression == compression {
+			return archive.extension
+		}
+	}
+	return ".tar"
+}
+
+// splitArchiveKey will split a tarball key into the name and the extension; ok is false for other objects.
+func splitArchiveKey(key string) (name, extension string, ok bool) {
+	for _, archive := range archiveExtensions {
+		if strings.HasSuffix(key, archive.extension) {
+			return strings.TrimSuffix(key, archive.extension), archive.extension, true
+		}
+	}
+	return key, "", false
+}
+
+// commandWriter feeds everything written to it to the standard input of a command.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close will close the input of the command and wait for it to finish.
+func (c *commandWriter) Close() error {
+	err := c.WriteCloser.Close()
+	if waitErr := c.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// commandReader reads the standard output of a command.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close will stop reading and wait for the command to finish.
+func (c *commandReader) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+// compressor will wrap w with the compression. Close must be called to flush it, w itself is not closed.
+func compressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZSTD:
+		cmd := exec.Command("zstd", "-q", "-c", "-T0")
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandWriter{stdin, cmd}, nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// nopWriteCloser passes uncompressed data through.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// decompress will wrap the tarball stored under key with decompression matching its extension.
+func decompress(key string, r io.Reader) (io.ReadCloser, error) {
+	_, extension, _ := splitArchiveKey(key)
+	switch extension {
+	case ".tar.gz":
+		return gzip.NewReader(r)
+	case ".tar.zst":
+		cmd := exec.Command("zstd", "-d", "-q", "-c")
+		cmd.Stdin = r
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandReader{stdout, cmd}, nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// writeArchive will write compressed tarball of source into w.
+func writeArchive(source, compression string, w io.Writer) error {
+	compressed, err := compressor(compression, w)
+	if err != nil {
+		return err
+	}
+	err = writeTar(source, compressed)
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// archive will stream compressed tarball of source straight into the storage under key, no intermediate file is
+// written. The whole stream is repeated if the upload fails, following the storage retry policy.
+func (app *GithubBackup) archive(source, key string) error {
+	fmt.Printf("[+] Spawning ARCHIVE routine: %s\n", key)
+
+	app.compressLimit.acquire()
+	defer app.compressLimit.release()
+	app.uploadLimit.acquire()
+	defer app.uploadLimit.release()
+
+	err := app.retry(app.config.Retry.Storage, key, func() error {
+		reader, writer := io.Pipe()
+		archived := make(chan error, 1)
+		go func() {
+			err := writeArchive(source, app.config.Compression, writer)
+			writer.CloseWithError(err)
+			archived <- err
+		}()
+
+		err := app.put(key, reader)
+		reader.CloseWithError(io.ErrClosedPipe) // stop archiving if the upload failed early
+		if archiveErr := <-archived; archiveErr != nil && archiveErr != io.ErrClosedPipe {
+			return inPhase(PHASE_COMPRESS, archiveErr)
+		}
+		return err
+	})
+
+	if _, ok := err.(*phaseError); err != nil && !ok {
+		return inPhase(PHASE_UPLOAD, fmt.Errorf("failed to upload data to %s: %s", key, err))
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveIsStreamedToStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "snapshot", "org", "repo")
+	checkErr(os.MkdirAll(filepath.Join(source, "refs"), 0755))
+	checkErr(ioutil.WriteFile(filepath.Join(source, "HEAD"), []byte("ref: refs/heads/master\n"), 0644))
+
+	storage, err := newLocalStorage(filepath.Join(dir, "storage"))
+	checkErr(err)
+
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		backup := &GithubBackup{config: &Config{Compression: compression}, storage: storage}
+		key := "snapshot/org/repo" + archiveExtension(compression)
+		if err := backup.archive(source, key); err != nil {
+			t.Fatal("Archiving failed: ", compression, err)
+		}
+
+		if leftovers, _ := filepath.Glob(source + ".tar*"); len(leftovers) > 0 {
+			t.Fatal("Intermediate file was written: ", leftovers)
+		}
+
+		body, err := storage.Get(key)
+		checkErr(err)
+		decompressed, err := decompress(key, body)
+		checkErr(err)
+
+		names := map[string]bool{}
+		tarball := tar.NewReader(decompressed)
+		for header, err := tarball.Next(); err == nil; header, err = tarball.Next() {
+			names[header.Name] = true
+		}
+		decompressed.Close()
+		body.Close()
+
+		if !names["repo/HEAD"] || !names["repo/refs"] {
+			t.Fatal("Archive has wrong content: ", compression, names)
+		}
+	}
+}
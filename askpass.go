@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// constants definitions of environment variables used to hand Github credentials to git. The binary itself acts as
+// GIT_ASKPASS program, so the secret never shows up in process arguments, git output or the cloned repository config.
+const (
+	ASKPASS_ENV          = "GHBACKUP_ASKPASS"
+	ASKPASS_USERNAME_ENV = "GHBACKUP_GIT_USERNAME"
+	ASKPASS_PASSWORD_ENV = "GHBACKUP_GIT_PASSWORD"
+)
+
+// askpass will answer a git credential prompt like "Username for 'https://github.com': " from the environment.
+func askpass(prompt string) string {
+	if strings.HasPrefix(strings.ToLower(prompt), "username") {
+		return os.Getenv(ASKPASS_USERNAME_ENV)
+	}
+	return os.Getenv(ASKPASS_PASSWORD_ENV)
+}
+
+// runAskpass will print the answer to the git prompt and return true if the binary was started by git as askpass
+// program.
+func runAskpass() bool {
+	if len(os.Getenv(ASKPASS_ENV)) == 0 {
+		return false
+	}
+
+	var prompt string
+	if len(os.Args) > 1 {
+		prompt = os.Args[1]
+	}
+	fmt.Println(askpass(prompt))
+	return true
+}
+
+// gitAuthCommand will create git command authenticating with given credentials through the askpass program. Stored
+// credentials and interactive prompts are disabled, so git either uses our credentials or fails.
+func gitAuthCommand(username, password string, args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", append([]string{"-c", "credential.helper="}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_ASKPASS="+executable,
+		"GIT_TERMINAL_PROMPT=0",
+		ASKPASS_ENV+"=1",
+		ASKPASS_USERNAME_ENV+"="+username,
+		ASKPASS_PASSWORD_ENV+"="+password,
+	)
+	return cmd, nil
+}
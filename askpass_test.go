@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary act as askpass and ssh program of the git processes it starts, just like the real
+// binary.
+func TestMain(m *testing.M) {
+	if runAskpass() || runSSH() {
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestAskpass(t *testing.T) {
+	os.Setenv(ASKPASS_USERNAME_ENV, "backup")
+	os.Setenv(ASKPASS_PASSWORD_ENV, "secret")
+	defer os.Unsetenv(ASKPASS_USERNAME_ENV)
+	defer os.Unsetenv(ASKPASS_PASSWORD_ENV)
+
+	if askpass("Username for 'https://github.com': ") != "backup" {
+		t.Fatal("Wrong answer to username prompt.")
+	}
+	if askpass("Password for 'https://backup@github.com': ") != "secret" {
+		t.Fatal("Wrong answer to password prompt.")
+	}
+}
+
+// fakeGitServer serves repositories in root over smart HTTP, requiring given basic auth credentials.
+func fakeGitServer(t *testing.T, root, username, password string) *httptest.Server {
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	checkErr(err)
+
+	backend := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+}
+
+// captureStdout will return everything fn printed to standard output.
+func captureStdout(fn func()) string {
+	reader, writer, err := os.Pipe()
+	checkErr(err)
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	fn()
+	os.Stdout = stdout
+	writer.Close()
+
+	output, err := ioutil.ReadAll(reader)
+	checkErr(err)
+	return string(output)
+}
+
+func TestMirrorKeepsCredentialsSecret(t *testing.T) {
+	const secret = "ghp_s3cr3tT0k3n"
+
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	git(t, dir, "init", "-q", "origin")
+	git(t, filepath.Join(dir, "origin"), "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, dir, "clone", "-q", "--bare", "origin", "remote/camunda/repo.git")
+
+	server := fakeGitServer(t, filepath.Join(dir, "remote"), "backup", secret)
+	defer server.Close()
+	cloneUrl := server.URL + "/camunda/repo.git"
+
+	backup := &GithubBackup{config: &Config{GithubAuth: AUTH_TOKEN, Username: "backup", Token: secret}}
+	repoPath := filepath.Join(dir, "backup", "repo")
+
+	var mirrorErr, tarErr error
+	var tarball bytes.Buffer
+	logs := captureStdout(func() {
+		mirrorErr = backup.mirror("camunda", "camunda/repo", cloneUrl, repoPath)
+		tarErr = writeTar(repoPath, &tarball)
+	})
+	if mirrorErr != nil || tarErr != nil {
+		t.Fatal("Authenticated clone failed: ", mirrorErr, tarErr)
+	}
+	if strings.Contains(logs, secret) {
+		t.Fatal("Secret was logged: ", logs)
+	}
+	if !strings.Contains(git(t, repoPath, "log", "--oneline", "--all"), "first") {
+		t.Fatal("Mirror does not contain the history.")
+	}
+
+	if bytes.Contains(tarball.Bytes(), []byte(secret)) {
+		t.Fatal("Secret was packed into the tarball.")
+	}
+
+	cmd, err := gitAuthCommand("backup", secret, "clone", "--mirror", cloneUrl, repoPath)
+	checkErr(err)
+	if strings.Contains(strings.Join(cmd.Args, " "), secret) {
+		t.Fatal("Secret is visible in git arguments: ", cmd.Args)
+	}
+
+	backup.config.Token = "wrong"
+	if err := backup.mirror("camunda", "camunda/repo", cloneUrl, repoPath); err == nil {
+		t.Fatal("Clone succeeded without valid credentials.")
+	}
+}
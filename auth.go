@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions of supported Github authentication methods.
+const (
+	AUTH_BASIC = "basic"
+	AUTH_TOKEN = "token"
+	AUTH_APP   = "app"
+
+	APP_TOKEN_USERNAME   = "x-access-token"
+	APP_JWT_LIFETIME     = 9 * time.Minute
+	APP_TOKEN_REFRESH_AT = 5 * time.Minute
+	APP_MEDIA_TYPE       = "application/vnd.github.machine-man-preview+json"
+)
+
+// tokenSource provides a token used to authenticate API calls and git operations.
+type tokenSource interface {
+	token() (string, error)
+}
+
+// staticToken is a personal access token.
+type staticToken string
+
+func (t staticToken) token() (string, error) {
+	return string(t), nil
+}
+
+// tokenTransport authenticates every request with a token from the source.
+type tokenTransport struct {
+	source tokenSource
+	scheme string
+	base   http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.token()
+	if err != nil {
+		return nil, err
+	}
+
+	authenticated := new(http.Request)
+	*authenticated = *req
+	authenticated.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		authenticated.Header[k] = v
+	}
+	authenticated.Header.Set("Authorization", t.scheme+" "+token)
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(authenticated)
+}
+
+// appJWT is a token source signing short-lived JSON Web Tokens which authenticate as the Github App itself.
+type appJWT struct {
+	appID string
+	key   *rsa.PrivateKey
+}
+
+// loadAppKey will read the PEM encoded private key of a Github App.
+func loadAppKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Github App private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// token will sign a new RS256 JWT issued by the app.
+func (a *appJWT) token() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(), // allow for clock drift
+		"exp": now.Add(APP_JWT_LIFETIME).Unix(),
+		"iss": a.appID,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationToken is a token source exchanging the app JWT for an installation token of a single organisation.
+// The token is refreshed shortly before it expires.
+type installationToken struct {
+	mu           sync.Mutex
+	ctx          context.Context
+	app          *github.Client
+	organisation string
+	installation int
+	current      string
+	expiresAt    time.Time
+}
+
+// token will return a valid installation token, creating a new one if the current expires soon.
+func (t *installationToken) token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.current) > 0 && t.expiresAt.Sub(time.Now()) > APP_TOKEN_REFRESH_AT {
+		return t.current, nil
+	}
+
+	if t.installation == 0 {
+		req, err := t.app.NewRequest("GET", fmt.Sprintf("orgs/%s/installation", t.organisation), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", APP_MEDIA_TYPE)
+
+		var installation github.Installation
+		if _, err := t.app.Do(t.ctx, req, &installation); err != nil {
+			return "", fmt.Errorf("Github App is not installed in %s: %s", t.organisation, err)
+		}
+		t.installation = installation.GetID()
+	}
+
+	req, err := t.app.NewRequest("POST", fmt.Sprintf("installations/%d/access_tokens", t.installation), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", APP_MEDIA_TYPE)
+
+	var created struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if _, err := t.app.Do(t.ctx, req, &created); err != nil {
+		return "", fmt.Errorf("cannot create installation token for %s: %s", t.organisation, err)
+	}
+
+	fmt.Printf("[+] Created Github App installation token for %s, expires at %s.\n",
+		t.organisation, created.ExpiresAt.Format(time.RFC3339))
+	t.current, t.expiresAt = created.Token, created.ExpiresAt
+	return t.current, nil
+}
+
+// newGithubClient will create Github API client on top of given transport, talking to the configured API URL.
+func (app *GithubBackup) newGithubClient(transport http.RoundTripper) *github.Client {
+	client := github.NewClient(&http.Client{Transport: transport})
+	if len(app.config.GithubURL) > 0 {
+		baseURL, err := url.Parse(app.config.GithubURL)
+		checkErr(err)
+		client.BaseURL = baseURL
+	}
+	return client
+}
+
+// login method will set up authentication of Github API calls with the configured method.
+func (app *GithubBackup) login() {
+	switch app.config.GithubAuth {
+	case AUTH_TOKEN:
+		app.client = app.newGithubClient(&tokenTransport{source: staticToken(app.config.Token), scheme: "token"})
+	case AUTH_APP:
+		key, err := loadAppKey(app.config.AppPrivateKey)
+		checkErr(err)
+		jwt := &appJWT{appID: app.config.AppID, key: key}
+		app.appClient = app.newGithubClient(&tokenTransport{source: jwt, scheme: "Bearer"})
+		app.installations = map[string]*installationToken{}
+		app.orgClients = map[string]*github.Client{}
+	default:
+		auth := github.BasicAuthTransport{
+			Username: app.config.Username, Password: app.config.Password, OTP: "", Transport: nil,
+		}
+		app.client = app.newGithubClient(&auth)
+	}
+}
+
+// installationFor will return the installation token source of the Github App for an organisation.
+func (app *GithubBackup) installationFor(organisation string) *installationToken {
+	app.authMu.Lock()
+	defer app.authMu.Unlock()
+
+	installation, ok := app.installations[organisation]
+	if !ok {
+		installation = &installationToken{ctx: app.context, app: app.appClient, organisation: organisation}
+		app.installations[organisation] = installation
+	}
+	return installation
+}
+
+// clientFor will return Github API client authenticated for an organisation. Only Github App authentication
+// needs a separate client per organisation installation.
+func (app *GithubBackup) clientFor(organisation string) *github.Client {
+	if app.config.GithubAuth != AUTH_APP {
+		return app.client
+	}
+
+	installation := app.installationFor(organisation)
+
+	app.authMu.Lock()
+	defer app.authMu.Unlock()
+	client, ok := app.orgClients[organisation]
+	if !ok {
+		client = app.newGithubClient(&tokenTransport{source: installation, scheme: "token"})
+		app.orgClients[organisation] = client
+	}
+	return client
+}
+
+// gitCredentials will return username and password used by git to clone repositories of an organisation.
+func (app *GithubBackup) gitCredentials(organisation string) (string, string, error) {
+	switch app.config.GithubAuth {
+	case AUTH_TOKEN:
+		username := app.config.Username
+		if len(username) == 0 {
+			username = APP_TOKEN_USERNAME
+		}
+		return username, app.config.Token, nil
+	case AUTH_APP:
+		token, err := app.installationFor(organisation).token()
+		return APP_TOKEN_USERNAME, token, err
+	}
+	return app.config.Username, app.config.Password, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestAppJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkErr(err)
+
+	token, err := (&appJWT{appID: "42", key: key}).token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("JWT has unexpected format: ", token)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	checkErr(err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatal("JWT signature is invalid: ", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	checkErr(err)
+	var claims struct {
+		Iss string `json:"iss"`
+		Exp int64  `json:"exp"`
+	}
+	checkErr(json.Unmarshal(payload, &claims))
+	if claims.Iss != "42" || claims.Exp > time.Now().Add(10*time.Minute).Unix() {
+		t.Fatal("JWT claims are wrong: ", claims)
+	}
+}
+
+// fakeGithubApp serves installation lookup and token creation, issuing tokens which expire after lifetime.
+func fakeGithubApp(lifetime time.Duration) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	created := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/orgs/camunda/installation":
+			fmt.Fprint(w, `{"id": 7}`)
+		case r.Method == "POST" && r.URL.Path == "/installations/7/access_tokens":
+			created++
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "installation-%d", "expires_at": "%s"}`,
+				created, time.Now().Add(lifetime).UTC().Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, &created
+}
+
+func newAppBackup(githubURL string) *GithubBackup {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkErr(err)
+
+	backup := &GithubBackup{
+		config:        &Config{GithubAuth: AUTH_APP, GithubURL: githubURL + "/"},
+		context:       context.Background(),
+		installations: map[string]*installationToken{},
+		orgClients:    map[string]*github.Client{},
+	}
+	backup.appClient = backup.newGithubClient(&tokenTransport{source: &appJWT{appID: "42", key: key}, scheme: "Bearer"})
+	return backup
+}
+
+func TestInstallationTokenIsReused(t *testing.T) {
+	server, created := fakeGithubApp(time.Hour)
+	defer server.Close()
+	backup := newAppBackup(server.URL)
+
+	for i := 0; i < 3; i++ {
+		username, password, err := backup.gitCredentials("camunda")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != APP_TOKEN_USERNAME || password != "installation-1" {
+			t.Fatal("Unexpected git credentials: ", username, password)
+		}
+	}
+	if *created != 1 {
+		t.Fatal("Valid installation token was not reused: ", *created)
+	}
+}
+
+func TestInstallationTokenIsRefreshedBeforeExpiry(t *testing.T) {
+	server, created := fakeGithubApp(APP_TOKEN_REFRESH_AT - time.Minute)
+	defer server.Close()
+	backup := newAppBackup(server.URL)
+
+	first, err := backup.installationFor("camunda").token()
+	checkErr(err)
+	second, err := backup.installationFor("camunda").token()
+	checkErr(err)
+
+	if first == second || *created != 2 {
+		t.Fatal("Expiring installation token was not refreshed: ", first, second)
+	}
+}
+
+func TestTokenTransport(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	backup := &GithubBackup{config: &Config{GithubAuth: AUTH_TOKEN, Token: "secret", GithubURL: server.URL + "/"}}
+	backup.login()
+	_, _, err := backup.clientFor("camunda").Repositories.ListByOrg(context.Background(), "camunda", nil)
+	checkErr(err)
+
+	if authorization != "token secret" {
+		t.Fatal("Personal access token was not sent: ", authorization)
+	}
+}
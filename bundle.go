@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions of supported output formats.
+const (
+	FORMAT_TAR                = "tar"
+	FORMAT_BUNDLE             = "bundle"
+	DEFAULT_BUNDLE_FULL_EVERY = 7
+)
+
+// bundleKey will return the key of n-th bundle in the chain of a repository. The full bundle has number 0.
+func bundleKey(repoPath string, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%s.bundle", repoPath)
+	}
+	return fmt.Sprintf("%s.%d.bundle", repoPath, n)
+}
+
+// createBundle will write all refs of a bare repository into a git bundle and verify it. Objects reachable from
+// excluded commits are left out, which makes the bundle incremental.
+func createBundle(repoPath, bundlePath string, exclude []string) error {
+	bundlePath, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-C", repoPath, "bundle", "create", bundlePath, "--all"}
+	if len(exclude) > 0 {
+		args = append(append(args, "--not"), exclude...)
+	}
+	if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git bundle create: %s: %s", err, output)
+	}
+
+	if output, err := exec.Command("git", "-C", repoPath, "bundle", "verify", bundlePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("git bundle verify: %s: %s", err, output)
+	}
+	return nil
+}
+
+// existingCommits will filter ref tips down to the objects which are still present in the repository. Tips
+// dropped by force-pushes cannot be used as prerequisites of an incremental bundle.
+func existingCommits(repoPath string, refs map[string]string) []string {
+	seen := map[string]bool{}
+	var commits []string
+	for _, sha := range refs {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		if exec.Command("git", "-C", repoPath, "cat-file", "-e", sha).Run() == nil {
+			commits = append(commits, sha)
+		}
+	}
+	return commits
+}
+
+// sameRefs will tell whether both ref maps hold the same refs pointing to the same objects.
+func sameRefs(previous, refs map[string]string) bool {
+	if len(previous) != len(refs) {
+		return false
+	}
+	for ref, sha := range refs {
+		if previous[ref] != sha {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNewTips will tell whether any of the refs points to a commit which was not a tip in the previous backup.
+// Otherwise an incremental bundle would be empty, which git refuses to create.
+func hasNewTips(previous, refs map[string]string) bool {
+	tips := map[string]bool{}
+	for _, sha := range previous {
+		tips[sha] = true
+	}
+	for _, sha := range refs {
+		if !tips[sha] {
+			return true
+		}
+	}
+	return false
+}
+
+// listsChangedRefs will tell whether a bundle lists every ref which is new or moved since the previous backup.
+func listsChangedRefs(listed, previous, refs map[string]string) bool {
+	for ref, sha := range refs {
+		if previous[ref] != sha && listed[ref] != sha {
+			return false
+		}
+	}
+	return true
+}
+
+// bundleRefs will list the refs stored in a bundle, without HEAD.
+func bundleRefs(bundlePath string) (map[string]string, error) {
+	output, err := exec.Command("git", "bundle", "list-heads", bundlePath).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] != "HEAD" {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// extendable will tell whether an incremental bundle can be added to the bundle chain of the state.
+func (s *repositoryState) extendable(fullEvery int) bool {
+	return s != nil && s.format() == FORMAT_BUNDLE && len(s.Refs) > 0 && len(s.Bundles) > 0 && len(s.Bundles) < fullEvery
+}
+
+// createIncrementalBundle will bundle the objects pushed since the previous backup as the next bundle of its chain.
+// git leaves refs pointing to commits of the previous backup out of an incremental bundle, e.g. a new tag on an old
+// commit. It returns an empty path if a new or moved ref would be lost that way, or if there are no new commits.
+func (app *GithubBackup) createIncrementalBundle(repo *github.Repository, repoPath string, refs map[string]string, previous *repositoryState) (string, error) {
+	if !previous.extendable(app.config.BundleFullEvery) || !hasNewTips(previous.Refs, refs) {
+		return "", nil
+	}
+	exclude := existingCommits(repoPath, previous.Refs)
+	if len(exclude) == 0 {
+		return "", nil
+	}
+
+	bundlePath := bundleKey(repoPath, len(previous.Bundles))
+	app.compressLimit.acquire()
+	err := createBundle(repoPath, bundlePath, exclude)
+	app.compressLimit.release()
+	if err != nil {
+		return "", err
+	}
+
+	listed, err := bundleRefs(bundlePath)
+	if err != nil || !listsChangedRefs(listed, previous.Refs, refs) {
+		fmt.Printf("[~] Refs of %s point to old commits, creating full bundle.\n", *repo.FullName)
+		os.Remove(bundlePath)
+		return "", err
+	}
+	return bundlePath, nil
+}
+
+// uploadBundle will upload a cloned repository as a git bundle. If the previous backup was a bundle chain shorter
+// than bundle_full_every, the chain is copied into the current snapshot and only an incremental bundle with objects
+// pushed since then is uploaded. Ref changes an incremental bundle cannot hold get a new full bundle. Empty
+// repositories have nothing to bundle, git refuses to create an empty bundle, so they are only recorded.
+func (app *GithubBackup) uploadBundle(repo *github.Repository, repoPath string, refs map[string]string, previous *repositoryState) (*repositoryState, error) {
+	state := &repositoryState{Refs: refs, Format: FORMAT_BUNDLE}
+	if len(refs) == 0 {
+		fmt.Printf("[~] %s is empty, there is nothing to bundle.\n", repo.GetFullName())
+		return state, nil
+	}
+
+	if previous.extendable(app.config.BundleFullEvery) && sameRefs(previous.Refs, refs) {
+		return app.reuseBackup(repo, repoPath, previous)
+	}
+
+	bundlePath, err := app.createIncrementalBundle(repo, repoPath, refs, previous)
+	if err == nil && len(bundlePath) > 0 {
+		reused, err := app.reuseBackup(repo, repoPath, previous)
+		if err == nil {
+			state.Bundles = reused.Bundles
+			app.manifest.refs(repoPath, refs) // reuse recorded the refs of the previous backup
+		} else {
+			fmt.Printf("[!] cannot reuse bundles of %s, creating full bundle: %s\n", *repo.FullName, err)
+			os.Remove(bundlePath)
+			bundlePath = ""
+		}
+	}
+	if err == nil && len(bundlePath) == 0 {
+		bundlePath = bundleKey(repoPath, 0)
+		app.compressLimit.acquire()
+		err = createBundle(repoPath, bundlePath, nil)
+		app.compressLimit.release()
+	}
+	if err != nil {
+		return nil, inPhase(PHASE_COMPRESS, err)
+	}
+	defer os.Remove(bundlePath)
+
+	if err := app.uploadFile(bundlePath); err != nil {
+		return nil, err
+	}
+	state.Bundles = append(state.Bundles, bundlePath)
+	state.Key = bundlePath
+	return state, nil
+}
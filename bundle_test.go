@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// git will run git command in given directory and fail the test on error.
+func git(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestIncrementalBundles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	checkErr(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+	backup := &GithubBackup{config: &Config{Format: FORMAT_BUNDLE, BundleFullEvery: 7}, storage: storage}
+	repo := &github.Repository{Name: github.String("repo"), FullName: github.String("org/repo")}
+
+	git(t, ".", "init", "-q", "origin")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, ".", "clone", "-q", "--mirror", "origin", "first/org/repo")
+
+	refs, err := listRefs("first/org/repo")
+	checkErr(err)
+	first, err := backup.uploadBundle(repo, "first/org/repo", refs, nil)
+	checkErr(err)
+	if len(first.Bundles) != 1 || first.Bundles[0] != "first/org/repo.bundle" {
+		t.Fatal("Wrong full bundle: ", first.Bundles)
+	}
+
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "second")
+	git(t, ".", "clone", "-q", "--mirror", "origin", "second/org/repo")
+
+	refs, err = listRefs("second/org/repo")
+	checkErr(err)
+	second, err := backup.uploadBundle(repo, "second/org/repo", refs, first)
+	checkErr(err)
+	if len(second.Bundles) != 2 || second.Bundles[1] != "second/org/repo.1.bundle" {
+		t.Fatal("Wrong incremental bundle chain: ", second.Bundles)
+	}
+
+	git(t, ".", "clone", "-q", "--mirror", filepath.Join("storage", second.Bundles[0]), "restored")
+	git(t, "restored", "fetch", "-q", filepath.Join("..", "storage", second.Bundles[1]), "refs/*:refs/*")
+	if git(t, "restored", "log", "--format=%s", "-1", "--all") != "second" {
+		t.Fatal("Incremental bundle does not contain the new commit.")
+	}
+
+	// a new tag on an existing commit brings no new objects, so the chain starts over with a full bundle
+	git(t, "origin", "tag", "v1.2")
+	third := nextBundle(t, backup, repo, "third", second)
+	if len(third.Bundles) != 1 || third.Bundles[0] != "third/org/repo.bundle" {
+		t.Fatal("New ref without new commits did not create a full bundle: ", third.Bundles)
+	}
+	if listed, err := bundleRefs(filepath.Join("storage", third.Bundles[0])); err != nil || !sameRefs(listed, third.Refs) {
+		t.Fatal("Full bundle does not list all refs: ", listed, err)
+	}
+
+	// an incremental bundle would leave out a tag on an old commit
+	git(t, "origin", "tag", "v1.1", "HEAD~1")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "fourth")
+	fourth := nextBundle(t, backup, repo, "fourth", third)
+	if len(fourth.Bundles) != 1 {
+		t.Fatal("Tag on an old commit was bundled incrementally: ", fourth.Bundles)
+	}
+
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "fifth")
+	fifth := nextBundle(t, backup, repo, "fifth", fourth)
+	if len(fifth.Bundles) != 2 {
+		t.Fatal("Unchanged tags prevented an incremental bundle: ", fifth.Bundles)
+	}
+	if !sameRefs(fifth.Refs, mirrorRefs(t, "fifth/org/repo")) {
+		t.Fatal("State does not record the current refs: ", fifth.Refs)
+	}
+
+	// a branch is force-pushed and a tag deleted between the bundles of the chain
+	git(t, "origin", "branch", "topic")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "topic")
+	git(t, "origin", "branch", "-f", "topic")
+	sixth := nextBundle(t, backup, repo, "sixth", fifth)
+	rewritten := git(t, "origin", "commit-tree", "HEAD~1^{tree}", "-p", "HEAD~1", "-m", "rewritten")
+	git(t, "origin", "update-ref", "refs/heads/topic", rewritten)
+	git(t, "origin", "tag", "-d", "v1.2")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "seventh")
+	seventh := nextBundle(t, backup, repo, "seventh", sixth)
+	if len(seventh.Bundles) != 4 {
+		t.Fatal("Force-push was not bundled incrementally: ", seventh.Bundles)
+	}
+
+	checkErr(backup.unpackBundles(seventh.Bundles, seventh.Refs, "chain"))
+	if restored := mirrorRefs(t, "chain"); !sameRefs(restored, seventh.Refs) {
+		t.Fatal("Restored refs differ from the backup: ", restored, seventh.Refs)
+	}
+}
+
+// nextBundle will mirror origin into a new snapshot and bundle it on top of the previous state.
+func nextBundle(t *testing.T, backup *GithubBackup, repo *github.Repository, snapshot string, previous *repositoryState) *repositoryState {
+	repoPath := snapshot + "/org/repo"
+	git(t, ".", "clone", "-q", "--mirror", "origin", repoPath)
+	state, err := backup.uploadBundle(repo, repoPath, mirrorRefs(t, repoPath), previous)
+	checkErr(err)
+	return state
+}
+
+func mirrorRefs(t *testing.T, repoPath string) map[string]string {
+	refs, err := listRefs(repoPath)
+	checkErr(err)
+	return refs
+}
+
+func TestBundleOfEmptyRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	checkErr(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+	snapshot := RenderTime(time.Now())
+	backup := &GithubBackup{config: &Config{Format: FORMAT_BUNDLE, BundleFullEvery: 7}, storage: storage, createdAt: snapshot}
+	backup.manifest = newManifestRecorder(snapshot)
+	repo := &github.Repository{Name: github.String("empty"), FullName: github.String("org/empty")}
+
+	git(t, ".", "init", "-q", "--bare", "origin.git")
+	repoPath := snapshot + "/org/empty"
+	git(t, ".", "clone", "-q", "--mirror", "origin.git", repoPath)
+	refs := mirrorRefs(t, repoPath)
+	backup.manifest.refs(repoPath, refs)
+
+	state, err := backup.uploadBundle(repo, repoPath, refs, nil)
+	if err != nil {
+		t.Fatal("Empty repository failed: ", err)
+	}
+	if len(state.Bundles) != 0 {
+		t.Fatal("Bundle of an empty repository was recorded: ", state.Bundles)
+	}
+	backup.manifest.finish(repoPath, nil)
+	checkErr(backup.writeManifest(true))
+
+	manifest, err := backup.loadManifest(snapshot)
+	checkErr(err)
+	if !manifest.Complete || manifest.repository("org", "empty").Status != STATUS_OK {
+		t.Fatal("Empty repository was not recorded as backed up: ", manifest)
+	}
+	if objects, _ := storage.List(snapshot + "/org/"); len(objects) != 0 {
+		t.Fatal("Artifacts of an empty repository were stored: ", objects)
+	}
+
+	opts := &verifyOptions{Snapshot: snapshot, Organisation: "org", Pattern: "*", Sample: 100}
+	if err := backup.verify(opts); err != nil {
+		t.Fatal("Snapshot with an empty repository failed verification: ", err)
+	}
+}
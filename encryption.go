@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// constants definitions of the encrypted archive format. An encrypted object starts with the magic, the id of the
+// master key, the data key wrapped with it and a random nonce prefix, followed by AES-256-GCM sealed chunks. The
+// nonce of a chunk is the prefix, the chunk counter and a flag marking the last chunk, so reordered or truncated
+// archives fail to decrypt.
+const (
+	ENCRYPTION_MAGIC        = "GHBENC1\n"
+	ENCRYPTION_ALGORITHM    = "AES-256-GCM-STREAM"
+	ENCRYPTION_CHUNK_SIZE   = 64 * 1024
+	ENCRYPTION_KEY_SIZE     = 32
+	ENCRYPTION_NONCE_PREFIX = 7
+
+	META_ENCRYPTION = "ghbackup-encryption"
+	META_KEY_ID     = "ghbackup-key-id"
+)
+
+// EncryptionConfig enables client-side encryption of uploaded backups. KeyFile holds all master keys, one
+// `<id> <base64 encoded 32 byte key>` per line; KeyID selects the one new backups are encrypted with. Older keys stay
+// in the file so backups encrypted before a rotation can still be restored.
+type EncryptionConfig struct {
+	KeyFile string `yaml:"key_file"`
+	KeyID   string `yaml:"key_id"`
+}
+
+// keyProvider wraps per-object data keys with master keys. It is the extension point for external key management
+// services; the archive format only depends on the key id and the wrapped key.
+type keyProvider interface {
+	// wrap will encrypt the data key with the active master key and return its id.
+	wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// unwrap will decrypt the data key with the master key of given id.
+	unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// fileKeyring is a keyProvider with master keys read from a local file.
+type fileKeyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// loadKeyring will read master keys from a file. The active key must be present if set, it is not needed to decrypt.
+func loadKeyring(path, active string) (*fileKeyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &fileKeyring{active: active, keys: map[string][]byte{}}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `<id> <base64 key>`", path, n+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ENCRYPTION_KEY_SIZE {
+			return nil, fmt.Errorf("%s:%d: key %s is not a base64 encoded %d byte key", path, n+1, fields[0],
+				ENCRYPTION_KEY_SIZE)
+		}
+		keyring.keys[fields[0]] = key
+	}
+
+	if _, ok := keyring.keys[active]; len(active) > 0 && !ok {
+		return nil, fmt.Errorf("encryption key %q is not in %s", active, path)
+	}
+	return keyring, nil
+}
+
+// newGCM will create AES-GCM cipher with given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *fileKeyring) wrap(dataKey []byte) (string, []byte, error) {
+	master, ok := k.keys[k.active]
+	if !ok {
+		return "", nil, errors.New("no encryption key is configured")
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.active, gcm.Seal(nonce, nonce, dataKey, []byte(k.active)), nil
+}
+
+func (k *fileKeyring) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	master, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is unknown", keyID)
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(keyID))
+}
+
+// chunkNonce will derive the nonce of n-th chunk.
+func chunkNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, ENCRYPTION_NONCE_PREFIX+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[ENCRYPTION_NONCE_PREFIX:], n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// writeField will write length prefixed field of the header.
+func writeField(w io.Writer, field []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(field)))
+	w.Write(field)
+}
+
+// readField will read length prefixed field of the header.
+func readField(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	_, err := io.ReadFull(r, field)
+	return field, err
+}
+
+// encryptWriter encrypts everything written to it in chunks. Close must be called to seal the last chunk.
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newEncryptWriter will generate a data key, wrap it with the provider and write the header to w.
+func newEncryptWriter(w io.Writer, keys keyProvider) (*encryptWriter, error) {
+	dataKey := make([]byte, ENCRYPTION_KEY_SIZE)
+	prefix := make([]byte, ENCRYPTION_NONCE_PREFIX)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := keys.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(ENCRYPTION_MAGIC)
+	writeField(&header, []byte(keyID))
+	writeField(&header, wrapped)
+	header.Write(prefix)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	writer := &encryptWriter{w: w, gcm: gcm, header: header.Bytes(), prefix: prefix}
+	writer.buf = make([]byte, 0, ENCRYPTION_CHUNK_SIZE)
+	return writer, nil
+}
+
+// seal will encrypt and write the buffered chunk.
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == ENCRYPTION_CHUNK_SIZE {
+			// the chunk is sealed only when more data follows, the last one is sealed by Close
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):ENCRYPTION_CHUNK_SIZE], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close will seal the last chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader decrypts archives written by encryptWriter.
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// newDecryptReader will read the header of an encrypted archive and unwrap its data key. The magic must have been
+// consumed already by the caller.
+func newDecryptReader(r *bufio.Reader, keys keyProvider) (*decryptReader, error) {
+	keyID, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, ENCRYPTION_NONCE_PREFIX)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	dataKey, err := keys.unwrap(string(keyID), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(ENCRYPTION_MAGIC)
+	writeField(&header, keyID)
+	writeField(&header, wrapped)
+	header.Write(prefix)
+
+	return &decryptReader{
+		r: r, gcm: gcm, header: header.Bytes(), prefix: prefix,
+		sealed: make([]byte, ENCRYPTION_CHUNK_SIZE+gcm.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.r, d.sealed)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		}
+
+		plain, err := d.gcm.Open(nil, chunkNonce(d.prefix, d.counter, d.done), d.sealed[:n], d.header)
+		if err != nil {
+			return 0, fmt.Errorf("encrypted archive is corrupted or truncated: %s", err)
+		}
+		d.counter++
+		d.plain = plain
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// objectBody reads an object, decrypted if needed, and closes it when done.
+type objectBody struct {
+	io.Reader
+	io.Closer
+}
+
+// put will store body under key, encrypting it first if encryption is configured. The key id is attached to the
+// object as metadata and the stored object is recorded in the snapshot manifest.
+func (app *GithubBackup) put(key string, body io.Reader) error {
+	if app.keys == nil {
+		return app.store(key, body, nil)
+	}
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		encrypted, err := newEncryptWriter(writer, app.keys)
+		if err == nil {
+			_, err = io.Copy(encrypted, body)
+			if closeErr := encrypted.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+
+	err := app.store(key, reader, map[string]string{
+		META_ENCRYPTION: ENCRYPTION_ALGORITHM,
+		META_KEY_ID:     app.config.Encryption.KeyID,
+	})
+	reader.CloseWithError(io.ErrClosedPipe) // unblock the encryption if the upload failed early
+	<-done
+	return err
+}
+
+// get will open the object stored under key, decrypting it if it is encrypted.
+func (app *GithubBackup) get(key string) (io.ReadCloser, error) {
+	body, err := app.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(body)
+	magic, err := buffered.Peek(len(ENCRYPTION_MAGIC))
+	if err != nil || string(magic) != ENCRYPTION_MAGIC {
+		return objectBody{buffered, body}, nil // plaintext, possibly shorter than the magic
+	}
+
+	if app.keys == nil {
+		body.Close()
+		return nil, fmt.Errorf("%s is encrypted but no encryption key file is configured", key)
+	}
+	buffered.Discard(len(ENCRYPTION_MAGIC))
+	decrypted, err := newDecryptReader(buffered, app.keys)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("cannot decrypt %s: %s", key, err)
+	}
+	return objectBody{decrypted, body}, nil
+}
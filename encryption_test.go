@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeyring will write a key file with given key ids and random keys.
+func writeKeyring(path string, ids ...string) {
+	var data bytes.Buffer
+	data.WriteString("# test keys\n")
+	for _, id := range ids {
+		key := make([]byte, ENCRYPTION_KEY_SIZE)
+		rand.Read(key)
+		fmt.Fprintf(&data, "%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	checkErr(ioutil.WriteFile(path, data.Bytes(), 0600))
+}
+
+func TestEncryptionWithKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(filepath.Join(dir, "storage"))
+	checkErr(err)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyring(keyFile, "2025", "2026")
+
+	oldKeys, err := loadKeyring(keyFile, "2025")
+	checkErr(err)
+	backup := &GithubBackup{config: &Config{Encryption: EncryptionConfig{KeyFile: keyFile, KeyID: "2025"}},
+		storage: storage, keys: oldKeys}
+
+	archives := map[string][]byte{
+		"old/org/repo.tar":   bytes.Repeat([]byte("source code "), 3*ENCRYPTION_CHUNK_SIZE/12+5),
+		"old/org/exact.tar":  bytes.Repeat([]byte("x"), 2*ENCRYPTION_CHUNK_SIZE),
+		"old/org/empty.json": {},
+	}
+	for key, data := range archives {
+		checkErr(backup.put(key, bytes.NewReader(data)))
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "storage", "old", "org", "repo.tar"))
+	checkErr(err)
+	if bytes.Contains(stored, []byte("source code")) {
+		t.Fatal("Archive was stored in plaintext.")
+	}
+
+	// rotate the key, backups encrypted with the old one must stay readable
+	backup.keys, err = loadKeyring(keyFile, "2026")
+	checkErr(err)
+	backup.config.Encryption.KeyID = "2026"
+	archives["new/org/repo.tar"] = []byte("rotated")
+	checkErr(backup.put("new/org/repo.tar", bytes.NewReader(archives["new/org/repo.tar"])))
+
+	for key, data := range archives {
+		body, err := backup.get(key)
+		if err != nil {
+			t.Fatal("Cannot open encrypted archive: ", key, err)
+		}
+		decrypted, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatal("Archive was not decrypted correctly: ", key, err)
+		}
+	}
+
+	// truncated archives must not decrypt silently
+	path := filepath.Join(dir, "storage", "old", "org", "exact.tar")
+	stored, err = ioutil.ReadFile(path)
+	checkErr(err)
+	checkErr(ioutil.WriteFile(path, stored[:len(stored)-ENCRYPTION_CHUNK_SIZE/2], 0644))
+	body, err := backup.get("old/org/exact.tar")
+	checkErr(err)
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Fatal("Truncated archive was decrypted.")
+	}
+	body.Close()
+
+	writeKeyring(keyFile, "2027")
+	backup.keys, err = loadKeyring(keyFile, "2027")
+	checkErr(err)
+	if _, err := backup.get("new/org/repo.tar"); err == nil {
+		t.Fatal("Archive was opened with an unknown key.")
+	}
+}
+
+func TestPlaintextObjectsAreReadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+	checkErr(storage.Put("snapshot/org/repo.issues.json", bytes.NewReader([]byte("[]")), nil))
+
+	body, err := (&GithubBackup{config: &Config{}, storage: storage}).get("snapshot/org/repo.issues.json")
+	checkErr(err)
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "[]" {
+		t.Fatal("Plaintext object was changed: ", string(data))
+	}
+}
+
+func TestEncryptionKeyIdInS3Metadata(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	writeKeyring(keyFile, "2026")
+	keys, err := loadKeyring(keyFile, "2026")
+	checkErr(err)
+
+	backup := &GithubBackup{config: &Config{Encryption: EncryptionConfig{KeyFile: keyFile, KeyID: "2026"}},
+		storage: storage, keys: keys}
+	checkErr(backup.put("snapshot/org/repo.tar", bytes.NewReader([]byte("mirror"))))
+
+	metadata := fake.metadata["snapshot/org/repo.tar"]
+	if metadata[META_KEY_ID] != "2026" || metadata[META_ENCRYPTION] != ENCRYPTION_ALGORITHM {
+		t.Fatal("Key id was not stored in object metadata: ", metadata)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions of repository filters.
+const (
+	FILTER_DEFAULT = "*"
+
+	VISIBILITY_PUBLIC   = "public"
+	VISIBILITY_PRIVATE  = "private"
+	VISIBILITY_INTERNAL = "internal"
+)
+
+// RepositoryFilter selects repositories of an organisation to back up. Name patterns are globs, or regular
+// expressions when enclosed in slashes, e.g. `/^zeebe-.*$/`. Archived and Forks keep both kinds when not set,
+// MaxSizeMB of 0 means no limit.
+type RepositoryFilter struct {
+	Include       []string `yaml:"include"`
+	Exclude       []string `yaml:"exclude"`
+	Archived      *bool    `yaml:"archived"`
+	Forks         *bool    `yaml:"forks"`
+	Visibility    []string `yaml:"visibility"`
+	Topics        []string `yaml:"topics"`
+	ExcludeTopics []string `yaml:"exclude_topics"`
+	MaxSizeMB     int      `yaml:"max_size_mb"`
+}
+
+// listedRepository is a repository as listed by the Github API, with attributes the vendored client does not know.
+type listedRepository struct {
+	*github.Repository
+	Archived   bool     `json:"archived"`
+	Topics     []string `json:"topics"`
+	Visibility string   `json:"visibility"`
+}
+
+// visibility will return the visibility of the repository, derived from its private flag if Github did not send it.
+func (repo *listedRepository) visibility() string {
+	if len(repo.Visibility) > 0 {
+		return repo.Visibility
+	}
+	if repo.GetPrivate() {
+		return VISIBILITY_PRIVATE
+	}
+	return VISIBILITY_PUBLIC
+}
+
+// isRegexpPattern will check whether a name pattern is a regular expression enclosed in slashes.
+func isRegexpPattern(pattern string) bool {
+	return len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// matchName will match a repository name against a glob or regular expression pattern.
+func matchName(pattern, name string) bool {
+	if isRegexpPattern(pattern) {
+		matched, err := regexp.MatchString(pattern[1:len(pattern)-1], name)
+		return err == nil && matched
+	}
+	matched, err := filepath.Match(pattern, name)
+	return err == nil && matched
+}
+
+// matchAny will check whether the name matches any of the patterns.
+func matchAny(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if matchName(pattern, name) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// hasTopic will find the first of the topics the repository is tagged with.
+func hasTopic(repo *listedRepository, topics []string) (string, bool) {
+	for _, topic := range topics {
+		for _, tagged := range repo.Topics {
+			if strings.EqualFold(topic, tagged) {
+				return topic, true
+			}
+		}
+	}
+	return "", false
+}
+
+// check will return an error describing the first invalid pattern or visibility of the filter.
+func (f *RepositoryFilter) check() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if isRegexpPattern(pattern) {
+			if _, err := regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+				return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+			}
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+	for _, visibility := range f.Visibility {
+		if visibility != VISIBILITY_PUBLIC && visibility != VISIBILITY_PRIVATE && visibility != VISIBILITY_INTERNAL {
+			return fmt.Errorf("unknown visibility %q", visibility)
+		}
+	}
+	return nil
+}
+
+// skip will return why the repository is not selected by the filter, or an empty string if it is.
+func (f *RepositoryFilter) skip(repo *listedRepository) string {
+	name := repo.GetName()
+	if _, ok := matchAny(f.Include, name); len(f.Include) > 0 && !ok {
+		return "not included"
+	}
+	if pattern, ok := matchAny(f.Exclude, name); ok {
+		return "excluded by " + pattern
+	}
+	if f.Archived != nil && repo.Archived != *f.Archived {
+		return fmt.Sprintf("archived is %t", repo.Archived)
+	}
+	if f.Forks != nil && repo.GetFork() != *f.Forks {
+		return fmt.Sprintf("fork is %t", repo.GetFork())
+	}
+	if len(f.Visibility) > 0 {
+		visible := false
+		for _, visibility := range f.Visibility {
+			visible = visible || visibility == repo.visibility()
+		}
+		if !visible {
+			return repo.visibility()
+		}
+	}
+	if _, ok := hasTopic(repo, f.Topics); len(f.Topics) > 0 && !ok {
+		return "no matching topic"
+	}
+	if topic, ok := hasTopic(repo, f.ExcludeTopics); ok {
+		return "topic " + topic
+	}
+	// Github reports the size in kilobytes
+	if f.MaxSizeMB > 0 && repo.GetSize() > f.MaxSizeMB*1024 {
+		return fmt.Sprintf("%d MB is over the size limit", repo.GetSize()/1024)
+	}
+	return ""
+}
+
+// filterFor will return the filter of an organisation, falling back to the default one configured under "*".
+func (c *Config) filterFor(organisation string) RepositoryFilter {
+	if filter, ok := c.Filters[organisation]; ok {
+		return filter
+	}
+	return c.Filters[FILTER_DEFAULT]
+}
+
+// listRepositories will fetch all repositories of an organisation. The request is made directly so that attributes
+// unknown to the vendored client, such as archived and topics, are decoded too.
+func (app *GithubBackup) listRepositories(organisation string) ([]*listedRepository, error) {
+	client := app.clientFor(organisation)
+	url := fmt.Sprintf("orgs/%s/repos?per_page=100", organisation)
+
+	var allRepos []*listedRepository
+	for {
+		var repos []*listedRepository
+		resp, err := app.callGithub(organisation, func() (*github.Response, error) {
+			req, err := client.NewRequest("GET", url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Accept", "application/vnd.github.mercy-preview+json") // topics
+			return client.Do(app.context, req, &repos)
+		})
+		if err != nil {
+			return nil, err
+		}
+		allRepos = append(allRepos, repos...)
+		if resp.NextPage == 0 {
+			break
+		}
+		url = fmt.Sprintf("orgs/%s/repos?per_page=100&page=%d", organisation, resp.NextPage)
+	}
+	return allRepos, nil
+}
+
+// selectRepositories will apply the filter of the organisation to listed repositories. Skipped repositories are
+// returned with the reason.
+func (app *GithubBackup) selectRepositories(organisation string, repos []*listedRepository) ([]*github.Repository, map[string]string) {
+	filter := app.config.filterFor(organisation)
+	var selected []*github.Repository
+	skipped := map[string]string{}
+	for _, repo := range repos {
+		if reason := filter.skip(repo); len(reason) > 0 {
+			skipped[repo.GetName()] = reason
+			continue
+		}
+		selected = append(selected, repo.Repository)
+	}
+	return selected, skipped
+}
+
+// runList is the entry point of the list subcommand, which prints the repositories a backup would include.
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	all := flags.Bool("all", false, "print skipped repositories too, with the reason")
+	flags.Parse(args)
+
+	app := NewGithubBackup()
+	app.config.checkCredentialsOrFail()
+	app.login()
+
+	failed := false
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "REPOSITORY\tSIZE MB\tSTATUS")
+	for _, organisation := range app.config.Organisations {
+		repos, err := app.listRepositories(organisation)
+		if err != nil {
+			fmt.Fprintf(table, "%s\t\tcannot list: %s\n", organisation, err)
+			failed = true
+			continue
+		}
+
+		_, skipped := app.selectRepositories(organisation, repos)
+		for _, repo := range repos {
+			status, ok := skipped[repo.GetName()]
+			if ok && !*all {
+				continue
+			}
+			if !ok {
+				status = "included"
+			} else {
+				status = "skipped: " + status
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\n", repo.GetFullName(), repo.GetSize()/1024, status)
+		}
+	}
+	table.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestRepositoryFilter(t *testing.T) {
+	no := false
+	filter := RepositoryFilter{
+		Include:       []string{"camunda-*", "/^zeebe(-.*)?$/"},
+		Exclude:       []string{"*-test-data"},
+		Archived:      &no,
+		Forks:         &no,
+		Visibility:    []string{VISIBILITY_PUBLIC, VISIBILITY_INTERNAL},
+		ExcludeTopics: []string{"no-backup"},
+		MaxSizeMB:     1024,
+	}
+	checkErr(filter.check())
+
+	repo := func(name string) *listedRepository {
+		return &listedRepository{Repository: &github.Repository{
+			Name: github.String(name), Fork: github.Bool(false), Private: github.Bool(false), Size: github.Int(100),
+		}}
+	}
+	cases := []struct {
+		repo   *listedRepository
+		reason string
+	}{
+		{repo("camunda-bpm"), ""},
+		{repo("zeebe"), ""},
+		{repo("zeebe-io"), ""},
+		{repo("zeebeio"), "not included"},
+		{repo("other"), "not included"},
+		{repo("camunda-test-data"), "excluded by *-test-data"},
+		{&listedRepository{Repository: repo("camunda-old").Repository, Archived: true}, "archived is true"},
+		{&listedRepository{Repository: repo("camunda-tagged").Repository, Topics: []string{"No-Backup"}}, "topic no-backup"},
+		{&listedRepository{Repository: repo("camunda-inner").Repository, Visibility: VISIBILITY_INTERNAL}, ""},
+	}
+	for _, c := range cases {
+		if reason := filter.skip(c.repo); reason != c.reason {
+			t.Errorf("skip(%s) = %q, expected %q", c.repo.GetName(), reason, c.reason)
+		}
+	}
+
+	fork := repo("camunda-fork")
+	fork.Fork = github.Bool(true)
+	private := repo("camunda-private")
+	private.Private = github.Bool(true)
+	huge := repo("camunda-huge")
+	huge.Size = github.Int(2048 * 1024)
+	for _, r := range []*listedRepository{fork, private, huge} {
+		if filter.skip(r) == "" {
+			t.Error("Repository was not skipped: ", r.GetName())
+		}
+	}
+
+	invalid := RepositoryFilter{Exclude: []string{"/(/"}}
+	if invalid.check() == nil {
+		t.Fatal("Invalid regular expression was accepted.")
+	}
+}
+
+func TestGetRepositoriesAppliesFilter(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/orgs/camunda/repos?per_page=100&page=2>; rel="next"`, server.URL))
+			fmt.Fprint(w, `[{"name": "camunda-bpm", "full_name": "camunda/camunda-bpm", "archived": false, "topics": ["java"]},
+				{"name": "camunda-old", "full_name": "camunda/camunda-old", "archived": true}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "zeebe", "full_name": "camunda/zeebe", "topics": ["go", "no-backup"]},
+			{"name": "camunda-modeler", "full_name": "camunda/camunda-modeler", "visibility": "internal"}]`)
+	}))
+	defer server.Close()
+
+	no := false
+	config := &Config{GithubAuth: AUTH_TOKEN, Token: "secret", GithubURL: server.URL + "/",
+		Filters: map[string]RepositoryFilter{
+			"camunda":      {Archived: &no, ExcludeTopics: []string{"no-backup"}},
+			FILTER_DEFAULT: {Include: []string{"nothing"}},
+		}}
+	backup := &GithubBackup{config: config, context: context.Background()}
+	backup.login()
+
+	repos, err := backup.getRepositories("camunda")
+	checkErr(err)
+	if len(repos) != 2 || repos[0].GetName() != "camunda-bpm" || repos[1].GetName() != "camunda-modeler" {
+		t.Fatal("Wrong repositories selected: ", repos)
+	}
+
+	listed, err := backup.listRepositories("camunda")
+	checkErr(err)
+	if _, skipped := backup.selectRepositories("other", listed); len(skipped) != 4 {
+		t.Fatal("Default filter was not applied: ", skipped)
+	}
+}
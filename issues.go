@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-github/github"
+)
+
+// issueBackup is a single issue together with all of its comments, as stored in the issues JSON document.
+type issueBackup struct {
+	Issue    *github.Issue          `json:"issue"`
+	Comments []*github.IssueComment `json:"comments"`
+}
+
+// getIssues will fetch all issues of a repository, both open and closed.
+func (app *GithubBackup) getIssues(owner, name string) ([]*github.Issue, error) {
+	opt := &github.IssueListByRepoOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var allIssues []*github.Issue
+	for {
+		var issues []*github.Issue
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			issues, resp, err = app.clientFor(owner).Issues.ListByRepo(app.context, owner, name, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allIssues = append(allIssues, issues...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return allIssues, nil
+}
+
+// getIssueComments will fetch all comments of a single issue.
+func (app *GithubBackup) getIssueComments(owner, name string, number int) ([]*github.IssueComment, error) {
+	opt := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var allComments []*github.IssueComment
+	for {
+		var comments []*github.IssueComment
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			comments, resp, err = app.clientFor(owner).Issues.ListComments(app.context, owner, name, number, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allComments = append(allComments, comments...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return allComments, nil
+}
+
+// backupIssues will export all issues of a repository with their comments and labels into a JSON document
+// stored next to the repository tarball.
+func (app *GithubBackup) backupIssues(repo *github.Repository, repoPath string) error {
+	if repo.HasIssues != nil && !*repo.HasIssues {
+		return nil
+	}
+	fmt.Printf("[+] Exporting issues of %s.\n", *repo.FullName)
+
+	owner, name := *repo.Owner.Login, *repo.Name
+	issues, err := app.getIssues(owner, name)
+	if err != nil {
+		return err
+	}
+
+	backup := make([]issueBackup, 0, len(issues))
+	for _, issue := range issues {
+		var comments []*github.IssueComment
+		if issue.GetComments() > 0 {
+			comments, err = app.getIssueComments(owner, name, issue.GetNumber())
+			if err != nil {
+				return err
+			}
+		}
+		backup = append(backup, issueBackup{Issue: issue, Comments: comments})
+	}
+
+	issuesFile := fmt.Sprintf("%s.issues.json", repoPath)
+	if err := writeJSON(issuesFile, backup); err != nil {
+		return err
+	}
+	defer os.Remove(issuesFile)
+
+	return app.uploadFile(issuesFile)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// newFakeGithub will serve given JSON pages by path. Every page but the last links to the next one, as GitHub does.
+func newFakeGithub(t *testing.T, pages map[string][]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathPages, ok := pages[r.URL.Path]
+		if !ok {
+			t.Errorf("Unexpected request: %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+
+		page := 1
+		if p := r.URL.Query().Get("page"); len(p) > 0 {
+			page, _ = strconv.Atoi(p)
+		}
+		if page < len(pathPages) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=100&page=%d>; rel="next"`, server.URL, r.URL.Path, page+1))
+		}
+		fmt.Fprint(w, pathPages[page-1])
+	}))
+	return server
+}
+
+// newFakeGithubBackup will log into the fake GitHub with a local storage, working in a temporary directory. The
+// returned function restores the working directory and removes everything.
+func newFakeGithubBackup(server *httptest.Server) (*GithubBackup, *localStorage, func()) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	wd, err := os.Getwd()
+	checkErr(err)
+	checkErr(os.Chdir(dir))
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+
+	config := &Config{GithubAuth: AUTH_TOKEN, Token: "secret", GithubURL: server.URL + "/", StreamThresholdMB: 1}
+	backup := &GithubBackup{config: config, context: context.Background(), storage: storage}
+	backup.login()
+
+	return backup, storage, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// readStoredJSON will decode an object of the storage.
+func readStoredJSON(t *testing.T, storage Storage, key string, v interface{}) {
+	body, err := storage.Get(key)
+	if err != nil {
+		t.Fatalf("Object %s was not stored: %s", key, err)
+	}
+	defer body.Close()
+	checkErr(json.NewDecoder(body).Decode(v))
+}
+
+func fakeRepository() *github.Repository {
+	return &github.Repository{
+		Name:      github.String("repo"),
+		FullName:  github.String("camunda/repo"),
+		Owner:     &github.User{Login: github.String("camunda")},
+		HasIssues: github.Bool(true),
+	}
+}
+
+func TestBackupIssues(t *testing.T) {
+	server := newFakeGithub(t, map[string][]string{
+		"/repos/camunda/repo/issues": {
+			`[{"number": 1, "title": "First", "comments": 2, "labels": [{"name": "bug"}]}]`,
+			`[{"number": 2, "title": "Second", "comments": 0}]`,
+		},
+		"/repos/camunda/repo/issues/1/comments": {
+			`[{"id": 11, "body": "first comment"}]`,
+			`[{"id": 12, "body": "second comment"}]`,
+		},
+	})
+	defer server.Close()
+
+	backup, storage, cleanup := newFakeGithubBackup(server)
+	defer cleanup()
+
+	checkErr(backup.backupIssues(fakeRepository(), "snap/camunda/repo"))
+
+	var issues []issueBackup
+	readStoredJSON(t, storage, "snap/camunda/repo.issues.json", &issues)
+	if len(issues) != 2 || issues[0].Issue.GetTitle() != "First" || issues[1].Issue.GetTitle() != "Second" {
+		t.Fatal("Issues of all pages were not stored: ", issues)
+	}
+	if len(issues[0].Issue.Labels) != 1 || issues[0].Issue.Labels[0].GetName() != "bug" {
+		t.Fatal("Labels were not stored: ", issues[0].Issue.Labels)
+	}
+	comments := issues[0].Comments
+	if len(comments) != 2 || comments[0].GetBody() != "first comment" || comments[1].GetBody() != "second comment" {
+		t.Fatal("Comments of all pages were not stored: ", comments)
+	}
+	if len(issues[1].Comments) != 0 {
+		t.Fatal("Comments of an issue without comments were fetched: ", issues[1].Comments)
+	}
+}
+
+func TestBackupIssuesDisabled(t *testing.T) {
+	server := newFakeGithub(t, nil)
+	defer server.Close()
+
+	backup, storage, cleanup := newFakeGithubBackup(server)
+	defer cleanup()
+
+	repo := fakeRepository()
+	repo.HasIssues = github.Bool(false)
+	checkErr(backup.backupIssues(repo, "snap/camunda/repo"))
+	if _, err := storage.Get("snap/camunda/repo.issues.json"); err != errObjectNotFound {
+		t.Fatal("Issues of a repository without issues were stored.")
+	}
+}
@@ -13,10 +13,9 @@ import (
 	"io/ioutil"
 	"gopkg.in/yaml.v2"
 	"github.com/google/go-github/github"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/joho/godotenv"
+	"encoding/json"
+	"errors"
 	"os/exec"
 )
 
@@ -24,6 +23,8 @@ import (
 const (
 	TMP_REPO_PATH = "%s/%s/%s"
 	DATETIME_LAYOUT = "02-01-2006-15:04:05"
+	S3_MIN_PART_SIZE = 5 * 1024 * 1024
+	DEFAULT_STREAM_THRESHOLD_MB = 100
 )
 
 // Config is runtime configuration data used in GithubBackup.
@@ -34,27 +35,103 @@ type Config struct {
 	AwsRegion string
 	Username string
 	Password string
+	Token string
+	AppID string
+	AppPrivateKey string
+	GithubAuth string `yaml:"github_auth"`
+	GithubURL string `yaml:"github_api_url"`
+	CloneProtocol string `yaml:"clone_protocol"`
+	SSH SSHConfig `yaml:"ssh"`
+	Encryption EncryptionConfig `yaml:"encryption"`
 	Organisations []string `yaml:"organisations"`
+	Filters map[string]RepositoryFilter `yaml:"filters"`
 	KeepLastBackupDays int `yaml:"keep_last_backup_days"`
+	Retention RetentionConfig `yaml:"retention"`
+	StreamThresholdMB int64 `yaml:"release_asset_stream_threshold_mb"`
+	Storage StorageConfig `yaml:"storage"`
+	Incremental bool `yaml:"incremental"`
+	Format string `yaml:"format"`
+	Compression string `yaml:"compression"`
+	BundleFullEvery int `yaml:"bundle_full_every"`
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+	Retry RetryConfig `yaml:"retry"`
 }
 
 // printAll is small helper method which will print parts of configuration to stdout.
 func (c *Config) printAll() {
+	fmt.Println("Storage: ", c.Storage.Type)
+	fmt.Println("Storage Path: ", c.Storage.Path)
 	fmt.Println("S3Bucket: ", c.S3Bucket)
+	fmt.Println("S3Endpoint: ", c.Storage.Endpoint)
 	fmt.Println("AwsAccessKey: ", c.AwsAccessKey)
 	fmt.Println("AwsRegion: ", c.AwsRegion)
+	fmt.Println("Github Auth: ", c.GithubAuth)
 	fmt.Println("Github User: ", c.Username)
+	fmt.Println("Github App: ", c.AppID)
+	fmt.Println("Clone protocol: ", c.CloneProtocol)
+	fmt.Println("Compression: ", c.Compression)
+	fmt.Println("Encryption key: ", c.Encryption.KeyID)
 	fmt.Println("Organisations: ", c.Organisations)
+	fmt.Println("Incremental: ", c.Incremental)
+	fmt.Println("Format: ", c.Format)
+	fmt.Printf("Concurrency: %+v\n", c.Concurrency)
+	fmt.Printf("Retention: last %d days, %+v\n", c.KeepLastBackupDays, c.Retention)
 }
 
+// checkOrFail will panic if the storage or the output format is not configured properly.
 func (c *Config) checkOrFail() {
-	dirty := len(c.AwsAccessKey) == 0 || len(c.AwsSecretAccessKey) == 0 || len(c.AwsRegion) == 0
-	dirty = dirty || len(c.S3Bucket) == 0 || len(c.Username) == 0 || len(c.Password) == 0
+	dirty := false
+	switch c.Storage.Type {
+	case STORAGE_S3:
+		dirty = dirty || len(c.AwsAccessKey) == 0 || len(c.AwsSecretAccessKey) == 0 || len(c.AwsRegion) == 0
+		dirty = dirty || len(c.S3Bucket) == 0
+	case STORAGE_LOCAL:
+		dirty = dirty || len(c.Storage.Path) == 0
+	default:
+		dirty = true
+	}
+	dirty = dirty || (c.Format != FORMAT_TAR && c.Format != FORMAT_BUNDLE)
+	dirty = dirty || !validCompression(c.Compression)
+	dirty = dirty || (len(c.Encryption.KeyID) > 0 && len(c.Encryption.KeyFile) == 0)
+	switch c.CloneProtocol {
+	case CLONE_HTTPS:
+	case CLONE_SSH:
+		dirty = dirty || len(c.SSH.PrivateKey) == 0 || len(c.SSH.KnownHosts) == 0
+	default:
+		dirty = true
+	}
 
 	if dirty {
 		c.printAll()
 		panic("[!] I'm missing configuration.")
 	}
+
+	for organisation, filter := range c.Filters {
+		if err := filter.check(); err != nil {
+			panic(fmt.Sprintf("[!] Invalid repository filter of %s: %s", organisation, err))
+		}
+	}
+}
+
+// checkCredentialsOrFail will panic if Github credentials of the configured method are missing. They are not
+// needed to restore backups.
+func (c *Config) checkCredentialsOrFail() {
+	var dirty bool
+	switch c.GithubAuth {
+	case AUTH_BASIC:
+		dirty = len(c.Username) == 0 || len(c.Password) == 0
+	case AUTH_TOKEN:
+		dirty = len(c.Token) == 0
+	case AUTH_APP:
+		dirty = len(c.AppID) == 0 || len(c.AppPrivateKey) == 0
+	default:
+		dirty = true
+	}
+
+	if dirty {
+		c.printAll()
+		panic("[!] I'm missing Github credentials.")
+	}
 }
 
 // readConfig will read .env file and config.yml to generate Config object for the runtime.
@@ -67,6 +144,28 @@ func readConfig() *Config {
 
 	var config Config
 	err = yaml.Unmarshal(yamlFile, &config)
+	checkErr(err)
+
+	if config.StreamThresholdMB == 0 {
+		config.StreamThresholdMB = DEFAULT_STREAM_THRESHOLD_MB
+	}
+	if len(config.Format) == 0 {
+		config.Format = FORMAT_TAR
+	}
+	if len(config.Compression) == 0 {
+		config.Compression = COMPRESSION_GZIP
+	}
+	if config.BundleFullEvery == 0 {
+		config.BundleFullEvery = DEFAULT_BUNDLE_FULL_EVERY
+	}
+	config.Concurrency.setDefaults()
+	config.Retry.setDefaults()
+	if len(config.Storage.Type) == 0 {
+		config.Storage.Type = STORAGE_S3
+	}
+	if len(config.CloneProtocol) == 0 {
+		config.CloneProtocol = CLONE_HTTPS
+	}
 
 	config.S3Bucket = os.Getenv("S3_BUCKET")
 	config.AwsAccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
@@ -74,6 +173,20 @@ func readConfig() *Config {
 	config.AwsRegion = os.Getenv("AWS_REGION")
 	config.Username = os.Getenv("GITHUB_USERNAME")
 	config.Password = os.Getenv("GITHUB_PASSWORD")
+	config.Token = os.Getenv("GITHUB_TOKEN")
+	config.AppID = os.Getenv("GITHUB_APP_ID")
+	config.AppPrivateKey = os.Getenv("GITHUB_APP_PRIVATE_KEY")
+
+	if len(config.GithubAuth) == 0 {
+		switch {
+		case len(config.Token) > 0:
+			config.GithubAuth = AUTH_TOKEN
+		case len(config.AppID) > 0:
+			config.GithubAuth = AUTH_APP
+		default:
+			config.GithubAuth = AUTH_BASIC
+		}
+	}
 
 	config.checkOrFail()
 	return &config
@@ -96,227 +209,407 @@ func ParseTime(t string) (time.Time, error) {
 	return time.Parse(DATETIME_LAYOUT, t)
 }
 
+// writeJSON is helper which will serialize given value as indented JSON document into a file.
+func writeJSON(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
 // GithubBackup contains all necessary elements to execute backup process.
 type GithubBackup struct {
 	config *Config
 	context context.Context
 	client *github.Client
 	wg         sync.WaitGroup
-	s3svc  *s3.S3
+	storage Storage
 	createdAt string
+	jobs chan repositoryJob
+	compressLimit limiter
+	uploadLimit limiter
+	report runReport
+	rateLimit rateLimiter
+	authMu sync.Mutex
+	appClient *github.Client
+	installations map[string]*installationToken
+	orgClients map[string]*github.Client
+	keys keyProvider
+	manifest *manifestRecorder
 }
 
-// uploadFileToS3 will upload specified file to S3 bucket.
-func (app *GithubBackup) uploadFileToS3(filePath string) {
-	defer app.wg.Done()
-	fmt.Printf("[+] Spawning S3UPLOAD routine: %s\n", filePath)
+// uploadFile will upload specified file to the storage. The file path is used as the key. Failed uploads are
+// retried with the storage retry policy.
+func (app *GithubBackup) uploadFile(filePath string) error {
+	fmt.Printf("[+] Spawning UPLOAD routine: %s\n", filePath)
 
 	file, err := os.Open(filePath)
+	if err != nil {
+		return inPhase(PHASE_UPLOAD, err)
+	}
 	defer file.Close()
-	checkErr(err)
-
-	stat, _ := file.Stat()
-	if stat.Size() == 0 { return } // file is empty. skip upload.
-
-	params := &s3.PutObjectInput{ Bucket: aws.String(app.config.S3Bucket), Key: aws.String(filePath), Body: file, }
-	_, err = app.s3svc.PutObject(params)
 
+	stat, err := file.Stat()
 	if err != nil {
-		fmt.Printf("Failed to upload data to %s/%s, %s\n", app.config.S3Bucket, filePath, err.Error())
-		panic(err) // TODO: delete that backup try completely
+		return inPhase(PHASE_UPLOAD, err)
 	}
-}
+	if stat.Size() == 0 { return nil } // file is empty. skip upload.
 
-func (app *GithubBackup) getS3Page(marker string) (*s3.ListObjectsOutput, error)  {
-	params := &s3.ListObjectsInput{
-		Bucket: aws.String(app.config.S3Bucket),
-	}
+	app.uploadLimit.acquire()
+	err = app.retry(app.config.Retry.Storage, filePath, func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return app.put(filePath, file)
+	})
+	app.uploadLimit.release()
 
-	if len(marker) > 0 {
-		params.Marker = aws.String(marker)
+	if err != nil {
+		return inPhase(PHASE_UPLOAD, fmt.Errorf("failed to upload data to %s: %s", filePath, err))
 	}
-
-	return app.s3svc.ListObjects(params)
+	return nil
 }
 
-// cleanup method will delete old backups. Backup which are older then specified in config will be deleted.
+// cleanup method will delete old backups. Whole snapshots which are not kept by the retention policy are deleted.
 func (app *GithubBackup) cleanup() {
 	fmt.Println("[+] Starting CLEANUP.")
 
 	os.RemoveAll(strings.Split(TMP_REPO_PATH, "/")[0])
 	os.RemoveAll(app.createdAt)
 
-	var objRefs []*s3.Object
-	var marker string
+	objRefs, err := app.listSnapshotObjects()
+	if err != nil {
+		app.report.fail("storage", inPhase(PHASE_CLEANUP, err))
+		return
+	}
+
+	// only objects of snapshots written by the backup are considered, anything else in the storage is left alone.
+	snapshots, skipped := groupSnapshots(objRefs)
+	if len(skipped) > 0 {
+		fmt.Printf("[~] Skipping %d objects which are not part of a snapshot, e.g. %s.\n", len(skipped), skipped[0])
+	}
 
-	for {
-		resp, _ := app.getS3Page(marker)
-		lastKey := resp.Contents[len(resp.Contents) - 1].Key
-		objRefs = append(objRefs, resp.Contents...)
+	unreadable := app.readManifests(snapshots)
+	keep := app.config.Retention.retain(snapshots, app.config.KeepLastBackupDays, time.Now())
+	keep[app.createdAt] = append(keep[app.createdAt], "running")
+
+	// the newest complete snapshot is never deleted, so a run of failed backups cannot wipe out the last good one.
+	latest := latestComplete(snapshots)
+	if len(latest) > 0 {
+		keep[latest] = append(keep[latest], "latest complete")
+	}
+	for _, name := range unreadable {
+		keep[name] = append(keep[name], "unreadable manifest")
+	}
 
-		if *resp.IsTruncated == true {
-			marker = *lastKey
-		} else {
-			break
+	fmt.Printf("[+] Found %d snapshots for cleanup.\n", len(snapshots))
+	for _, snapshot := range snapshots {
+		if reasons, ok := keep[snapshot.Name]; ok {
+			fmt.Printf("[+] Keeping snapshot %s (%s).\n", snapshot.Name, strings.Join(reasons, ", "))
+			continue
 		}
+		app.prune(snapshot)
 	}
+}
 
-	fmt.Printf("[+] Found %d objects for cleanup.\n", len(objRefs))
-	for _, key := range objRefs {
-		fmt.Println(*key.Key)
-		ts, _ := ParseTime(strings.Split(*key.Key, "/")[0])
-		if int(time.Since(ts).Hours())  > app.config.KeepLastBackupDays * 24 {
-			fmt.Printf("[+] Found an old backup. Deleting %s\n", *key.Key)
-			deleteParams := &s3.DeleteObjectInput{
-				Bucket: aws.String(app.config.S3Bucket), Key: key.Key,
-			}
-			output, err := app.s3svc.DeleteObject(deleteParams)
-			checkErr(err)
-			fmt.Printf("\n\n[+/!] S3 Delete Object executed: %s\n\n", output)
+// getRepositories will fetch repositories of an organisation selected by its filter in config.
+func (app *GithubBackup) getRepositories(organisation string) ([]*github.Repository, error) {
+	repos, err := app.listRepositories(organisation)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, skipped := app.selectRepositories(organisation, repos)
+	for _, repo := range repos {
+		if reason, ok := skipped[repo.GetName()]; ok {
+			fmt.Printf("[~] Skipping %s: %s.\n", repo.GetFullName(), reason)
 		}
 	}
+	return selected, nil
 }
 
-// login method will use provided Github credentials and retrieve authentication token.
-func (app *GithubBackup) login() {
-	auth := github.BasicAuthTransport{
-		Username:app.config.Username, Password: app.config.Password, OTP: "", Transport: nil,
+// gitCommand will create git command talking to the remote over the configured clone protocol with the
+// credentials of given organisation.
+func (app *GithubBackup) gitCommand(organisation string, args ...string) (*exec.Cmd, error) {
+	if app.config.CloneProtocol == CLONE_SSH {
+		return gitSSHCommand(app.config.SSH, args...)
 	}
-	app.client = github.NewClient(auth.Client())
+	username, password, err := app.gitCredentials(organisation)
+	if err != nil {
+		return nil, err
+	}
+	return gitAuthCommand(username, password, args...)
 }
 
-// getRepositories will fetch all repositories for specified organisations in config.
-func (app *GithubBackup) getRepositories(organisation string) ([]*github.Repository, error) {
-	opt := &github.RepositoryListByOrgOptions{
-		ListOptions: github.ListOptions{PerPage: 100},
+// errRemoteNotFound is returned by mirror when the remote repository does not exist.
+var errRemoteNotFound = errors.New("remote repository not found")
+
+// mirror will create a bare mirror of given remote in repoPath. Over HTTPS the credentials are passed to git through
+// the askpass program, the clone URL stays free of secrets. Over SSH the configured key and known_hosts are used.
+// Failed clones are retried with the git retry policy.
+func (app *GithubBackup) mirror(organisation, name, cloneUrl, repoPath string) error {
+	return app.retry(app.config.Retry.Git, name, func() error {
+		os.RemoveAll(repoPath) // leftovers of a failed attempt
+
+		cmd, err := app.gitCommand(organisation, "clone", "--mirror", cloneUrl, repoPath)
+		if err != nil {
+			return err
+		}
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			switch {
+			case strings.Contains(string(output), "not found"):
+				return errRemoteNotFound
+			case strings.Contains(string(output), SSH_HOST_KEY_FAILED):
+				fmt.Printf("[!] %s", output)
+				return errHostKeyRejected
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// cloneRepository will download git repository from Github and upload it as a tarball or a git bundle. In
+// incremental mode the artifacts of the last backup are reused when nothing was pushed to the repository since then.
+func (app *GithubBackup) cloneRepository(repo *github.Repository, repoPath string) error {
+	var previous *repositoryState
+	if app.config.Incremental {
+		previous = app.previousState(repo)
+		if previous != nil && previous.format() == app.config.Format && previous.unchanged(repo) &&
+			app.refsUnchanged(repo, previous) {
+			state, err := app.reuseBackup(repo, repoPath, previous)
+			if err == nil {
+				return app.recordState(repo, state)
+			}
+			fmt.Printf("[!] cannot reuse last backup of %s: %s\n", *repo.FullName, err)
+		}
 	}
 
-	var allRepos []*github.Repository
-	for {
-		repos, resp, err := app.client.Repositories.ListByOrg(app.context, organisation, opt)
+	fmt.Printf("[+] Trying to clone %s.\n", *repo.FullName)
+
+	if err := app.mirror(*repo.Owner.Login, *repo.FullName, app.cloneURL(repo), repoPath); err != nil {
+		fmt.Println(">> git clone ", app.cloneURL(repo), repoPath)
+		return inPhase(PHASE_CLONE, err)
+	}
+	defer os.RemoveAll(repoPath)
+
+	refs, err := listRefs(repoPath)
+	if err != nil {
+		return inPhase(PHASE_CLONE, fmt.Errorf("cannot list refs: %s", err))
+	}
+	app.manifest.refs(repoPath, refs)
+
+	var state *repositoryState
+	if app.config.Format == FORMAT_BUNDLE {
+		state, err = app.uploadBundle(repo, repoPath, refs, previous)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		allRepos = append(allRepos, repos...)
-		if resp.NextPage == 0 {
-			break
+	} else {
+		key := repoPath + archiveExtension(app.config.Compression)
+		if err := app.archive(repoPath, key); err != nil {
+			return err
 		}
-		opt.ListOptions.Page = resp.NextPage
+		state = &repositoryState{Refs: refs, Key: key}
+	}
+
+	if app.config.Incremental {
+		return app.recordState(repo, state)
 	}
-	return allRepos, nil
+	return nil
 }
 
-// cloneRepository will download git repository from Github and compress them into a tarball.
-func (app *GithubBackup) cloneRepository(repo *github.Repository, repoPath string) {
-	fmt.Printf("[+] Trying to clone %s.\n", *repo.FullName)
+// recordState will save the state of a repository after successful upload so the next run can build on it.
+func (app *GithubBackup) recordState(repo *github.Repository, state *repositoryState) error {
+	if repo.PushedAt == nil {
+		return nil
+	}
+
+	state.PushedAt = repo.PushedAt.Time
+	if err := app.saveState(repo, state); err != nil {
+		return inPhase(PHASE_UPLOAD, fmt.Errorf("cannot save state: %s", err))
+	}
+	return nil
+}
 
-	cloneUrl := *repo.CloneURL
-	credentialsUrl := fmt.Sprintf("https://%s:%s@%s",
-						os.Getenv("GITHUB_USERNAME"), os.Getenv("GITHUB_PASSWORD"),
-						cloneUrl[8:])
+// backupRepository will back up the git mirror and wiki of a repository together with its issues, pull requests
+// and releases. Failures are recorded in the run report and the manifest and do not stop the remaining steps.
+func (app *GithubBackup) backupRepository(repo *github.Repository, repoPath string) {
+	defer app.report.processed()
 
-	cmd := exec.Command("git", "clone", "--mirror", credentialsUrl, repoPath)
-	if err := cmd.Run(); err != nil {
-		fmt.Println("[!] git error: ", err)
-		fmt.Println(">> git clone ", *repo.CloneURL, repoPath)
-		return
+	var errs []string
+	fail := func(name, phase string, err error) {
+		err = inPhase(phase, err)
+		app.report.fail(name, err)
+		errs = append(errs, err.Error())
 	}
 
-	gitRepoCleanup := fmt.Sprintf("cd %s && git remote rm origin", repoPath)
-	rmRemote := exec.Command("/bin/sh", "-c", gitRepoCleanup) // Don't backup credentials.
-	if err := rmRemote.Run(); err != nil {
-		fmt.Printf("[!] cannot remove remote: %+#v\n", err)
+	cloneErr := app.cloneRepository(repo, repoPath)
+	if cloneErr != nil {
+		fail(*repo.FullName, PHASE_CLONE, cloneErr)
 	}
 
-	app.compress(repoPath, repoPath+"/../")
-	os.RemoveAll(repoPath)
-	repoBundle := fmt.Sprintf("%s.tar", repoPath)
-	app.uploadFileToS3(repoBundle)
+	if err := app.backupWiki(repo, repoPath, cloneErr == nil); err != nil {
+		fail(*repo.FullName+" (wiki)", PHASE_CLONE, err)
+	}
 
+	if err := app.backupIssues(repo, repoPath); err != nil {
+		fail(*repo.FullName+" (issues)", PHASE_EXPORT, err)
+	}
+
+	if err := app.backupPullRequests(repo, repoPath); err != nil {
+		fail(*repo.FullName+" (pull requests)", PHASE_EXPORT, err)
+	}
+
+	if err := app.backupReleases(repo, repoPath); err != nil {
+		fail(*repo.FullName+" (releases)", PHASE_EXPORT, err)
+	}
+
+	app.manifest.finish(repoPath, errs)
 }
 
-// downloadAll will fetch all repository endpoints for a given organisation and clone them to filesystem.
+// downloadAll will fetch all repository endpoints for a given organisation and queue them for the clone workers.
 func (app *GithubBackup) downloadAll(organisation string) {
 	repos, err := app.getRepositories(organisation)
-	if err != nil { return }
+	app.manifest.organisation(organisation, err)
+	if err != nil {
+		app.report.fail(organisation, inPhase(PHASE_LIST, err))
+		return
+	}
 
 	for _, repo := range repos {
 		path := fmt.Sprintf(TMP_REPO_PATH, app.createdAt, organisation, *repo.Name)
-		fmt.Printf("[+] Spawning GIT_CLONE routine: %s \n", *repo.CloneURL)
-		app.wg.Add(1)
-		go app.cloneRepository(repo, path)
+		fmt.Printf("[+] Queueing GIT_CLONE job: %s \n", app.cloneURL(repo))
+		app.jobs <- repositoryJob{repo, path}
 	}
 }
 
-// compress will create tarballs of cloned repositories.
-func (app *GithubBackup) compress(source, target string) error {
-	filename := filepath.Base(source)
-	target = filepath.Join(target, fmt.Sprintf("%s.tar", filename))
-	tarFile, err := os.Create(target)
-	checkErr(err)
-	defer tarFile.Close()
-
-	tarball := tar.NewWriter(tarFile)
-	defer tarball.Close()
+// writeTar will write tarball of a cloned repository into w.
+func writeTar(source string, w io.Writer) error {
+	tarball := tar.NewWriter(w)
 
 	info, err := os.Stat(source)
-	checkErr(err)
+	if err != nil {
+		return err
+	}
 
 	var baseDir string
 	if info.IsDir() {
 		baseDir = filepath.Base(source)
 	}
 
-	return filepath.Walk(source,
+	err = filepath.Walk(source,
 		func(path string, info os.FileInfo, err error) error {
-			checkErr(err)
+			if err != nil { return err }
 			header, err := tar.FileInfoHeader(info, info.Name())
-			checkErr(err)
+			if err != nil { return err }
 
 			if baseDir != "" { header.Name = filepath.Join(baseDir, strings.TrimPrefix(path, source)) }
-			err = tarball.WriteHeader(header)
-			checkErr(err)
+			if err := tarball.WriteHeader(header); err != nil { return err }
 
 			if info.IsDir() { return nil }
 
-			file, fsErr := os.Open(path)
-			checkErr(fsErr)
+			file, err := os.Open(path)
+			if err != nil { return err }
 
 			defer file.Close()
 			_, err = io.Copy(tarball, file)
-			checkErr(err)
-			return nil
+			return err
 		})
+	if err != nil {
+		return err
+	}
+	return tarball.Close()
 }
 
-// start is a helper method which will execute the backup process.
-func (app *GithubBackup) start() {
+// start is a helper method which will execute the backup process. It returns an error if any repository failed.
+func (app *GithubBackup) start() error {
 	fmt.Println("############################################################################")
 	fmt.Printf("[+] Starting a backup at %s.\n", app.createdAt)
 	app.config.printAll()
 	fmt.Println("############################################################################")
 
+	app.config.checkCredentialsOrFail()
+	if len(app.config.Encryption.KeyFile) > 0 && len(app.config.Encryption.KeyID) == 0 {
+		panic("[!] I'm missing the encryption key id to encrypt backups with.")
+	}
+
 	app.login()
+	app.manifest = newManifestRecorder(app.createdAt)
+	if err := app.writeManifest(false); err != nil {
+		app.report.fail(MANIFEST_NAME, inPhase(PHASE_UPLOAD, err))
+	}
+
+	app.startWorkers()
 	for _, org := range app.config.Organisations {
 		app.downloadAll(org)
 	}
 
+	close(app.jobs)
 	app.wg.Wait()
+	// uploads still unfinished failed for good, the next run writes into another snapshot and never resumes them
+	if err := app.storage.AbortUploads(app.createdAt + "/"); err != nil {
+		fmt.Printf("[!] cannot abort unfinished uploads: %s\n", err)
+	}
+	if err := app.writeManifest(true); err != nil {
+		app.report.fail(MANIFEST_NAME, inPhase(PHASE_UPLOAD, err))
+	}
 	app.cleanup()
+
+	if rate := app.rateLimit.remaining(); rate.Limit > 0 {
+		fmt.Printf("[+] Github API budget left: %d/%d.\n", rate.Remaining, rate.Limit)
+	}
+	app.report.printSummary(os.Stdout)
+	return app.report.err()
 }
 
 // NewGithubBackup is a construct function which will create new GithubBackup object with given attributes.
 func NewGithubBackup() *GithubBackup {
-	return &GithubBackup{
-		readConfig(),
-		context.Background(),
-		nil,
-		sync.WaitGroup{},
-		s3.New(session.Must(session.NewSession())),
-		RenderTime(time.Now()),
+	config := readConfig()
+	storage, err := newStorage(config)
+	checkErr(err)
+
+	app := &GithubBackup{
+		config: config,
+		context: context.Background(),
+		storage: storage,
+		createdAt: RenderTime(time.Now()),
+	}
+	if len(config.Encryption.KeyFile) > 0 {
+		app.keys, err = loadKeyring(config.Encryption.KeyFile, config.Encryption.KeyID)
+		checkErr(err)
 	}
+	return app
 }
 
 func main() {
-	NewGithubBackup().start()
+	if runAskpass() || runSSH() {
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		runList(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		runPrune(os.Args[2:])
+		return
+	}
+	if err := NewGithubBackup().start(); err != nil {
+		fmt.Println("[!] ", err)
+		os.Exit(1)
+	}
 }
@@ -29,13 +29,32 @@ func TestConfig(t *testing.T) {
 	}
 }
 
+func TestShippedConfig(t *testing.T) {
+	t.Setenv("S3_BUCKET", "backups")
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-central-1")
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GITHUB_APP_ID", "1")
+
+	config := readConfig()
+	if config.Format != FORMAT_TAR || config.Compression != COMPRESSION_GZIP {
+		t.Fatal("Format and compression were not read: ", config.Format, config.Compression)
+	}
+	if len(config.Organisations) == 0 {
+		t.Fatal("Organisations were not read.")
+	}
+	if config.GithubAuth != AUTH_APP {
+		t.Fatal("Authentication method was not picked from the environment: ", config.GithubAuth)
+	}
+}
+
 func TestCloneRepository(t *testing.T) {
 	backup := NewGithubBackup()
 	backup.login()
 
 	repos, err := backup.getRepositories("camunda-ci")
 	checkErr(err)
-	backup.wg.Add(2)
 
 	path := fmt.Sprintf(TMP_REPO_PATH, "test", "camunda-ci", *(repos[0].Name))
 	backup.cloneRepository(repos[0], path)
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// constants definitions of the snapshot manifest.
+const (
+	MANIFEST_NAME = "manifest.json"
+
+	STATUS_OK     = "ok"
+	STATUS_FAILED = "failed"
+)
+
+// version of the tool recorded in manifests, set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// manifestArtifact is a single object uploaded for a repository. SHA256 is the digest of the stored bytes, i.e.
+// after compression and encryption.
+type manifestArtifact struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// manifestRepository lists everything backed up of a single repository.
+type manifestRepository struct {
+	Organisation string             `json:"organisation"`
+	Name         string             `json:"name"`
+	Status       string             `json:"status"`
+	Errors       []string           `json:"errors,omitempty"`
+	Refs         map[string]string  `json:"refs,omitempty"`
+	Artifacts    []manifestArtifact `json:"artifacts"`
+}
+
+// manifestOrganisation records whether the repositories of an organisation could be listed.
+type manifestOrganisation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// snapshotManifest describes what a snapshot contains. It is written as <snapshot>/manifest.json when the run starts
+// and rewritten with Complete set once all uploads finished, so partial snapshots can be told apart.
+type snapshotManifest struct {
+	Snapshot      string                 `json:"snapshot"`
+	Version       string                 `json:"version"`
+	StartedAt     time.Time              `json:"started_at"`
+	FinishedAt    *time.Time             `json:"finished_at,omitempty"`
+	Complete      bool                   `json:"complete"`
+	Organisations []manifestOrganisation `json:"organisations"`
+	Repositories  []*manifestRepository  `json:"repositories"`
+}
+
+// manifestKey will return the key of the manifest of a snapshot.
+func manifestKey(snapshot string) string {
+	return snapshot + "/" + MANIFEST_NAME
+}
+
+// repository will find the entry of a repository in the manifest.
+func (m *snapshotManifest) repository(organisation, name string) *manifestRepository {
+	for _, repo := range m.Repositories {
+		if repo.Organisation == organisation && repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// artifact will find the entry of an uploaded object in the manifest.
+func (m *snapshotManifest) artifact(key string) (manifestArtifact, bool) {
+	for _, repo := range m.Repositories {
+		for _, artifact := range repo.Artifacts {
+			if artifact.Key == key {
+				return artifact, true
+			}
+		}
+	}
+	return manifestArtifact{}, false
+}
+
+// artifactRepoPath will derive the repository path (<snapshot>/<org>/<repo>) an uploaded object belongs to.
+func artifactRepoPath(key string) string {
+	segments := strings.SplitN(key, "/", 4)
+	if len(segments) == 4 {
+		return strings.Join(segments[:3], "/") // release assets and notes
+	}
+
+	for _, suffix := range []string{".issues.json", ".pulls.json"} {
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix)
+		}
+	}
+	if repoPath, _, ok := parseArtifactKey(key); ok {
+		return strings.TrimSuffix(repoPath, ".wiki")
+	}
+	return key
+}
+
+// manifestRecorder collects the manifest of the running backup from concurrent workers. A nil recorder records
+// nothing.
+type manifestRecorder struct {
+	mu           sync.Mutex
+	manifest     snapshotManifest
+	repositories map[string]*manifestRepository // by repository path
+	previous     map[string]*snapshotManifest   // manifests of earlier snapshots by snapshot
+}
+
+// newManifestRecorder will start the manifest of a snapshot.
+func newManifestRecorder(snapshot string) *manifestRecorder {
+	return &manifestRecorder{
+		manifest: snapshotManifest{
+			Snapshot: snapshot, Version: version, StartedAt: time.Now().UTC(),
+			Organisations: []manifestOrganisation{}, Repositories: []*manifestRepository{},
+		},
+		repositories: map[string]*manifestRepository{},
+		previous:     map[string]*snapshotManifest{},
+	}
+}
+
+// entry will return the manifest entry of a repository path, creating it if needed. Callers must hold the lock.
+func (r *manifestRecorder) entry(repoPath string) *manifestRepository {
+	repo, ok := r.repositories[repoPath]
+	if !ok {
+		repo = &manifestRepository{Status: STATUS_OK, Artifacts: []manifestArtifact{}}
+		segments := strings.Split(repoPath, "/")
+		if len(segments) == 3 {
+			repo.Organisation, repo.Name = segments[1], segments[2]
+		}
+		r.repositories[repoPath] = repo
+		r.manifest.Repositories = append(r.manifest.Repositories, repo)
+	}
+	return repo
+}
+
+// organisation will record whether the repositories of an organisation could be listed.
+func (r *manifestRecorder) organisation(name string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	org := manifestOrganisation{Name: name, Status: STATUS_OK}
+	if err != nil {
+		org.Status, org.Error = STATUS_FAILED, err.Error()
+	}
+	r.manifest.Organisations = append(r.manifest.Organisations, org)
+}
+
+// refs will record the ref tips of a backed up repository.
+func (r *manifestRecorder) refs(repoPath string, refs map[string]string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entry(repoPath).Refs = refs
+}
+
+// artifact will record an uploaded object.
+func (r *manifestRecorder) artifact(artifact manifestArtifact) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	repo := r.entry(artifactRepoPath(artifact.Key))
+	for i := range repo.Artifacts {
+		if repo.Artifacts[i].Key == artifact.Key {
+			repo.Artifacts[i] = artifact
+			return
+		}
+	}
+	repo.Artifacts = append(repo.Artifacts, artifact)
+}
+
+// finish will record the outcome of a repository backup.
+func (r *manifestRecorder) finish(repoPath string, errs []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	repo := r.entry(repoPath)
+	if len(errs) > 0 {
+		repo.Status, repo.Errors = STATUS_FAILED, errs
+	}
+}
+
+// snapshot will return a copy of the manifest with repositories sorted by organisation and name. A finished snapshot
+// is complete only if repositories of all organisations were listed and every repository was backed up.
+func (r *manifestRecorder) snapshot(finished bool) snapshotManifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	manifest := r.manifest
+	if finished {
+		now := time.Now().UTC()
+		manifest.FinishedAt = &now
+		manifest.Complete = true
+		for _, org := range manifest.Organisations {
+			manifest.Complete = manifest.Complete && org.Status == STATUS_OK
+		}
+		for _, repo := range manifest.Repositories {
+			manifest.Complete = manifest.Complete && repo.Status == STATUS_OK
+		}
+	}
+	manifest.Repositories = append([]*manifestRepository{}, r.manifest.Repositories...)
+	sort.Slice(manifest.Repositories, func(i, j int) bool {
+		a, b := manifest.Repositories[i], manifest.Repositories[j]
+		return a.Organisation < b.Organisation || (a.Organisation == b.Organisation && a.Name < b.Name)
+	})
+	for _, repo := range manifest.Repositories {
+		sort.Slice(repo.Artifacts, func(i, j int) bool { return repo.Artifacts[i].Key < repo.Artifacts[j].Key })
+	}
+	return manifest
+}
+
+// loadManifest will read the manifest of a snapshot. Snapshots created before manifests existed return
+// errObjectNotFound.
+func (app *GithubBackup) loadManifest(snapshot string) (*snapshotManifest, error) {
+	var manifest snapshotManifest
+	err := app.retry(app.config.Retry.Storage, manifestKey(snapshot), func() error {
+		body, err := app.storage.Get(manifestKey(snapshot))
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return json.NewDecoder(body).Decode(&manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// writeManifest will store the manifest of the running snapshot, finished once all uploads are done.
+func (app *GithubBackup) writeManifest(finished bool) error {
+	if app.manifest == nil {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(app.manifest.snapshot(finished), "", "  ")
+	if err != nil {
+		return err
+	}
+	return app.retry(app.config.Retry.Storage, manifestKey(app.createdAt), func() error {
+		return app.storage.Put(manifestKey(app.createdAt), bytes.NewReader(data), nil)
+	})
+}
+
+// digestReader computes size and SHA-256 of everything read through it.
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{r: r, hash: sha256.New()}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// artifact will return the manifest entry of the object read through the digest reader.
+func (d *digestReader) artifact(key string) manifestArtifact {
+	return manifestArtifact{Key: key, Size: d.size, SHA256: hex.EncodeToString(d.hash.Sum(nil))}
+}
+
+// digestSeeker will compute the digest of a seekable body up front and rewind it, so it stays seekable for
+// the storage.
+func digestSeeker(key string, body io.ReadSeeker) (manifestArtifact, error) {
+	digest := newDigestReader(body)
+	if _, err := io.Copy(ioutil.Discard, digest); err != nil {
+		return manifestArtifact{}, err
+	}
+	_, err := body.Seek(0, io.SeekStart)
+	return digest.artifact(key), err
+}
+
+// copy will duplicate an object of an earlier snapshot into the running one, recording it with the digest known
+// from the manifest of the earlier snapshot.
+func (app *GithubBackup) copy(src, dst string) error {
+	if err := app.storage.Copy(src, dst); err != nil {
+		return err
+	}
+	if app.manifest == nil {
+		return nil
+	}
+
+	snapshot := strings.SplitN(src, "/", 2)[0]
+	app.manifest.mu.Lock()
+	previous, loaded := app.manifest.previous[snapshot]
+	app.manifest.mu.Unlock()
+	if !loaded {
+		var err error
+		if previous, err = app.loadManifest(snapshot); err != nil {
+			fmt.Printf("[!] no manifest of snapshot %s: %s\n", snapshot, err)
+		}
+		app.manifest.mu.Lock()
+		app.manifest.previous[snapshot] = previous
+		app.manifest.mu.Unlock()
+	}
+
+	artifact := manifestArtifact{Key: dst}
+	if previous != nil {
+		if known, ok := previous.artifact(src); ok {
+			artifact.Size, artifact.SHA256 = known.Size, known.SHA256
+		}
+	}
+	app.manifest.artifact(artifact)
+	return nil
+}
+
+// store will put body into the storage under key and record the stored object in the manifest.
+func (app *GithubBackup) store(key string, body io.Reader, metadata map[string]string) error {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		artifact, err := digestSeeker(key, seeker)
+		if err != nil {
+			return err
+		}
+		if err := app.storage.Put(key, seeker, metadata); err != nil {
+			return err
+		}
+		app.manifest.artifact(artifact)
+		return nil
+	}
+
+	digest := newDigestReader(body)
+	if err := app.storage.Put(key, digest, metadata); err != nil {
+		return err
+	}
+	app.manifest.artifact(digest.artifact(key))
+	return nil
+}
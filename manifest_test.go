@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArtifactRepoPath(t *testing.T) {
+	cases := map[string]string{
+		"snap/org/repo.tar.gz":                 "snap/org/repo",
+		"snap/org/repo.wiki.tar.zst":           "snap/org/repo",
+		"snap/org/repo.2.bundle":               "snap/org/repo",
+		"snap/org/bpmn.io.bundle":              "snap/org/bpmn.io",
+		"snap/org/repo.issues.json":            "snap/org/repo",
+		"snap/org/repo.pulls.json":             "snap/org/repo",
+		"snap/org/repo/releases/v1.0/notes.md": "snap/org/repo",
+	}
+
+	for key, repoPath := range cases {
+		if got := artifactRepoPath(key); got != repoPath {
+			t.Errorf("artifactRepoPath(%q) = %q", key, got)
+		}
+	}
+}
+
+func TestManifestRecordsSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+
+	previous := RenderTime(time.Now().AddDate(0, 0, -1))
+	backup := &GithubBackup{config: &Config{}, storage: storage, createdAt: previous}
+	backup.manifest = newManifestRecorder(previous)
+	checkErr(backup.put(previous+"/org/unchanged.tar", strings.NewReader("unchanged mirror")))
+	checkErr(backup.writeManifest(true))
+
+	snapshot := RenderTime(time.Now())
+	backup = &GithubBackup{config: &Config{}, storage: storage, createdAt: snapshot}
+	backup.manifest = newManifestRecorder(snapshot)
+	checkErr(backup.writeManifest(false))
+
+	started, err := backup.loadManifest(snapshot)
+	checkErr(err)
+	if started.Complete || started.FinishedAt != nil {
+		t.Fatal("Running snapshot was marked complete.")
+	}
+
+	backup.manifest.organisation("org", nil)
+	backup.manifest.refs(snapshot+"/org/repo", map[string]string{"refs/heads/master": "abc"})
+	checkErr(backup.put(snapshot+"/org/repo.tar.gz", bytes.NewReader([]byte("mirror"))))
+	checkErr(backup.put(snapshot+"/org/repo.issues.json", strings.NewReader("[]")))
+	backup.manifest.finish(snapshot+"/org/repo", nil)
+	checkErr(backup.copy(previous+"/org/unchanged.tar", snapshot+"/org/unchanged.tar"))
+	backup.manifest.finish(snapshot+"/org/unchanged", nil)
+	checkErr(backup.writeManifest(true))
+
+	manifest, err := backup.loadManifest(snapshot)
+	checkErr(err)
+	if !manifest.Complete || manifest.FinishedAt == nil || manifest.Version != version {
+		t.Fatal("Finished snapshot was not marked complete: ", manifest)
+	}
+
+	backup.manifest.finish(snapshot+"/org/broken", []string{"clone failed"})
+	checkErr(backup.writeManifest(true))
+
+	manifest, err = backup.loadManifest(snapshot)
+	checkErr(err)
+	if manifest.Complete || manifest.FinishedAt == nil {
+		t.Fatal("Finished snapshot with a failed repository was marked complete: ", manifest)
+	}
+
+	repo := manifest.repository("org", "repo")
+	if repo == nil || repo.Status != STATUS_OK || repo.Refs["refs/heads/master"] != "abc" || len(repo.Artifacts) != 2 {
+		t.Fatal("Repository was not recorded: ", repo)
+	}
+	digest := sha256.Sum256([]byte("mirror"))
+	if artifact, _ := manifest.artifact(snapshot + "/org/repo.tar.gz"); artifact.Size != 6 ||
+		artifact.SHA256 != hex.EncodeToString(digest[:]) {
+		t.Fatal("Artifact digest is wrong: ", artifact)
+	}
+
+	digest = sha256.Sum256([]byte("unchanged mirror"))
+	if artifact, _ := manifest.artifact(snapshot + "/org/unchanged.tar"); artifact.SHA256 != hex.EncodeToString(digest[:]) {
+		t.Fatal("Digest of reused artifact was not taken from the previous manifest: ", artifact)
+	}
+
+	if broken := manifest.repository("org", "broken"); broken == nil || broken.Status != STATUS_FAILED {
+		t.Fatal("Failed repository was not recorded: ", broken)
+	}
+}
+
+func TestSnapshotWithFailedOrganisationIsIncomplete(t *testing.T) {
+	recorder := newManifestRecorder(RenderTime(time.Now()))
+	recorder.organisation("org", nil)
+	recorder.organisation("other", errors.New("forbidden"))
+
+	if manifest := recorder.snapshot(true); manifest.Complete {
+		t.Fatal("Snapshot missing an organisation was marked complete.")
+	}
+}
+
+func TestCleanupKeepsLatestCompleteSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+
+	complete := RenderTime(time.Now().AddDate(0, 0, -20))
+	partial := RenderTime(time.Now().AddDate(0, 0, -10))
+	for snapshot, finished := range map[string]bool{complete: true, partial: false} {
+		backup := &GithubBackup{config: &Config{}, storage: storage, createdAt: snapshot}
+		backup.manifest = newManifestRecorder(snapshot)
+		checkErr(backup.put(snapshot+"/org/repo.tar", strings.NewReader(snapshot)))
+		checkErr(backup.writeManifest(finished))
+	}
+
+	backup := &GithubBackup{config: &Config{KeepLastBackupDays: 7}, storage: storage, createdAt: RenderTime(time.Now())}
+	backup.cleanup()
+
+	objects, err := storage.List("")
+	checkErr(err)
+	if len(objects) != 2 {
+		t.Fatal("Wrong objects left after cleanup: ", objects)
+	}
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, complete+"/") {
+			t.Fatal("Latest complete snapshot was not kept: ", objects)
+		}
+	}
+}
+
+func TestRestoreUsesManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+
+	snapshot := RenderTime(time.Now())
+	backup := &GithubBackup{config: &Config{}, storage: storage, createdAt: snapshot}
+	backup.manifest = newManifestRecorder(snapshot)
+	checkErr(backup.put(snapshot+"/org/repo.tar", strings.NewReader("mirror")))
+	checkErr(backup.writeManifest(true))
+	checkErr(storage.Put(snapshot+"/org/stray.tar", strings.NewReader("leftover"), nil))
+
+	artifacts, err := backup.findArtifacts(&restoreOptions{Snapshot: snapshot, Organisation: "org", Pattern: "*"})
+	checkErr(err)
+	if len(artifacts) != 1 || artifacts["repo"] == nil || artifacts["repo"].Tarball != snapshot+"/org/repo.tar" {
+		t.Fatal("Artifacts were not taken from the manifest: ", artifacts)
+	}
+}
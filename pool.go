@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions of default concurrency limits.
+const (
+	DEFAULT_CLONE_CONCURRENCY    = 8
+	DEFAULT_COMPRESS_CONCURRENCY = 4
+	DEFAULT_UPLOAD_CONCURRENCY   = 8
+)
+
+// ConcurrencyConfig limits how many repositories are processed at once in every phase of the backup.
+type ConcurrencyConfig struct {
+	Clone    int `yaml:"clone"`
+	Compress int `yaml:"compress"`
+	Upload   int `yaml:"upload"`
+}
+
+// setDefaults will fill in default limits for phases which were not configured.
+func (c *ConcurrencyConfig) setDefaults() {
+	if c.Clone <= 0 {
+		c.Clone = DEFAULT_CLONE_CONCURRENCY
+	}
+	if c.Compress <= 0 {
+		c.Compress = DEFAULT_COMPRESS_CONCURRENCY
+	}
+	if c.Upload <= 0 {
+		c.Upload = DEFAULT_UPLOAD_CONCURRENCY
+	}
+}
+
+// limiter bounds the number of concurrently running operations of a single phase. A nil limiter does not limit.
+type limiter chan struct{}
+
+// newLimiter will create a limiter allowing n concurrent operations.
+func newLimiter(n int) limiter {
+	return make(limiter, n)
+}
+
+// acquire will block until a slot is free.
+func (l limiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+// release will free a slot taken by acquire.
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// repositoryJob is a single repository waiting in the queue of the worker pool.
+type repositoryJob struct {
+	repo *github.Repository
+	path string
+}
+
+// startWorkers will spawn the configured number of clone workers consuming repositories from the job queue.
+func (app *GithubBackup) startWorkers() {
+	app.jobs = make(chan repositoryJob)
+	app.compressLimit = newLimiter(app.config.Concurrency.Compress)
+	app.uploadLimit = newLimiter(app.config.Concurrency.Upload)
+
+	for i := 0; i < app.config.Concurrency.Clone; i++ {
+		app.wg.Add(1)
+		go app.worker()
+	}
+	fmt.Printf("[+] Started %d GIT_CLONE workers.\n", app.config.Concurrency.Clone)
+}
+
+// worker will back up repositories from the job queue until it is closed.
+func (app *GithubBackup) worker() {
+	defer app.wg.Done()
+	for job := range app.jobs {
+		app.backupRepository(job.repo, job.path)
+	}
+}
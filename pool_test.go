@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterBoundsConcurrency(t *testing.T) {
+	limit := newLimiter(3)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	running, maxRunning := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit.acquire()
+			defer limit.release()
+
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 3 {
+		t.Fatal("Wrong number of concurrent operations: ", maxRunning)
+	}
+}
+
+func TestConcurrencyDefaults(t *testing.T) {
+	config := ConcurrencyConfig{Compress: 2}
+	config.setDefaults()
+
+	if config.Clone != DEFAULT_CLONE_CONCURRENCY || config.Compress != 2 || config.Upload != DEFAULT_UPLOAD_CONCURRENCY {
+		t.Fatal("Wrong concurrency defaults: ", config)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/go-github/github"
+)
+
+// PULL_REQUEST_REVIEWS_MEDIA_TYPE is the media type of the review endpoints.
+const PULL_REQUEST_REVIEWS_MEDIA_TYPE = "application/vnd.github.black-cat-preview+json"
+
+// pullRequestBackup is a single pull request together with its review history, as stored in the pulls JSON document.
+type pullRequestBackup struct {
+	PullRequest        *github.PullRequest          `json:"pull_request"`
+	ReviewComments     []*github.PullRequestComment `json:"review_comments"`
+	Reviews            []*github.PullRequestReview  `json:"reviews"`
+	RequestedReviewers []*github.User               `json:"requested_reviewers"`
+	RequestedTeams     []*github.Team               `json:"requested_teams,omitempty"`
+}
+
+// requestedReviewers is a page of the requested reviewers endpoint.
+type requestedReviewers struct {
+	Users []*github.User `json:"users"`
+	Teams []*github.Team `json:"teams"`
+}
+
+// getPullRequests will fetch all pull requests of a repository, both open and closed.
+func (app *GithubBackup) getPullRequests(owner, name string) ([]*github.PullRequest, error) {
+	opt := &github.PullRequestListOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var allPulls []*github.PullRequest
+	for {
+		var pulls []*github.PullRequest
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			pulls, resp, err = app.clientFor(owner).PullRequests.List(app.context, owner, name, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allPulls = append(allPulls, pulls...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return allPulls, nil
+}
+
+// getReviewComments will fetch all inline review comments of a single pull request.
+func (app *GithubBackup) getReviewComments(owner, name string, number int) ([]*github.PullRequestComment, error) {
+	opt := &github.PullRequestListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var allComments []*github.PullRequestComment
+	for {
+		var comments []*github.PullRequestComment
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			comments, resp, err = app.clientFor(owner).PullRequests.ListComments(app.context, owner, name, number, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allComments = append(allComments, comments...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return allComments, nil
+}
+
+// getPages will fetch every page of a review endpoint, which the vendored client does not paginate, and pass each
+// page to collect.
+func (app *GithubBackup) getPages(owner, name, path string, collect func(page json.RawMessage) error) error {
+	client := app.clientFor(owner)
+	for page := 1; page != 0; {
+		var data json.RawMessage
+		resp, err := app.callGithub(owner+"/"+name, func() (*github.Response, error) {
+			req, err := client.NewRequest("GET", fmt.Sprintf("%s?per_page=100&page=%d", path, page), nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Accept", PULL_REQUEST_REVIEWS_MEDIA_TYPE)
+			return client.Do(app.context, req, &data)
+		})
+		if err != nil {
+			return err
+		}
+		if err := collect(data); err != nil {
+			return err
+		}
+		page = resp.NextPage
+	}
+	return nil
+}
+
+// getPullRequestBackup will fetch review comments, reviews and requested reviewers of a single pull request.
+func (app *GithubBackup) getPullRequestBackup(owner, name string, pull *github.PullRequest) (*pullRequestBackup, error) {
+	number := pull.GetNumber()
+
+	comments, err := app.getReviewComments(owner, name, number)
+	if err != nil {
+		return nil, err
+	}
+
+	var reviews []*github.PullRequestReview
+	err = app.getPages(owner, name, fmt.Sprintf("repos/%s/%s/pulls/%d/reviews", owner, name, number),
+		func(page json.RawMessage) error {
+			var pageReviews []*github.PullRequestReview
+			err := json.Unmarshal(page, &pageReviews)
+			reviews = append(reviews, pageReviews...)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var reviewers requestedReviewers
+	err = app.getPages(owner, name, fmt.Sprintf("repos/%s/%s/pulls/%d/requested_reviewers", owner, name, number),
+		func(page json.RawMessage) error {
+			var pageReviewers requestedReviewers
+			err := json.Unmarshal(page, &pageReviewers)
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				// Older API versions return the requested users as a plain array.
+				err = json.Unmarshal(page, &pageReviewers.Users)
+			}
+			reviewers.Users = append(reviewers.Users, pageReviewers.Users...)
+			reviewers.Teams = append(reviewers.Teams, pageReviewers.Teams...)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pullRequestBackup{
+		PullRequest:        pull,
+		ReviewComments:     comments,
+		Reviews:            reviews,
+		RequestedReviewers: reviewers.Users,
+		RequestedTeams:     reviewers.Teams,
+	}, nil
+}
+
+// backupPullRequests will export all pull requests of a repository with their reviews and review comments into
+// a JSON document stored next to the repository tarball.
+func (app *GithubBackup) backupPullRequests(repo *github.Repository, repoPath string) error {
+	fmt.Printf("[+] Exporting pull requests of %s.\n", *repo.FullName)
+
+	owner, name := *repo.Owner.Login, *repo.Name
+	pulls, err := app.getPullRequests(owner, name)
+	if err != nil {
+		return err
+	}
+
+	backup := make([]*pullRequestBackup, 0, len(pulls))
+	for _, pull := range pulls {
+		pullBackup, err := app.getPullRequestBackup(owner, name, pull)
+		if err != nil {
+			return err
+		}
+		backup = append(backup, pullBackup)
+	}
+
+	pullsFile := fmt.Sprintf("%s.pulls.json", repoPath)
+	if err := writeJSON(pullsFile, backup); err != nil {
+		return err
+	}
+	defer os.Remove(pullsFile)
+
+	return app.uploadFile(pullsFile)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBackupPullRequests(t *testing.T) {
+	server := newFakeGithub(t, map[string][]string{
+		"/repos/camunda/repo/pulls": {
+			`[{"number": 1, "title": "Feature", "state": "open"}]`,
+			`[{"number": 2, "title": "Fix", "state": "closed"}]`,
+		},
+		"/repos/camunda/repo/pulls/1/comments": {
+			`[{"id": 11, "body": "nit", "path": "main.go"}]`,
+			`[{"id": 12, "body": "done", "path": "main.go"}]`,
+		},
+		"/repos/camunda/repo/pulls/2/comments": {`[]`},
+		"/repos/camunda/repo/pulls/1/reviews": {
+			`[{"id": 21, "state": "CHANGES_REQUESTED", "body": "please fix"}]`,
+			`[{"id": 22, "state": "APPROVED", "body": "lgtm"}]`,
+		},
+		"/repos/camunda/repo/pulls/2/reviews": {`[]`},
+		"/repos/camunda/repo/pulls/1/requested_reviewers": {
+			`{"users": [{"login": "alice"}], "teams": [{"slug": "core"}]}`,
+			`{"users": [{"login": "bob"}], "teams": []}`,
+		},
+		"/repos/camunda/repo/pulls/2/requested_reviewers": {`[{"login": "carol"}]`},
+	})
+	defer server.Close()
+
+	backup, storage, cleanup := newFakeGithubBackup(server)
+	defer cleanup()
+
+	checkErr(backup.backupPullRequests(fakeRepository(), "snap/camunda/repo"))
+
+	var pulls []pullRequestBackup
+	readStoredJSON(t, storage, "snap/camunda/repo.pulls.json", &pulls)
+	if len(pulls) != 2 || pulls[0].PullRequest.GetTitle() != "Feature" || pulls[1].PullRequest.GetTitle() != "Fix" {
+		t.Fatal("Pull requests of all pages were not stored: ", pulls)
+	}
+
+	feature := pulls[0]
+	if len(feature.ReviewComments) != 2 || feature.ReviewComments[1].GetBody() != "done" {
+		t.Fatal("Review comments of all pages were not stored: ", feature.ReviewComments)
+	}
+	if len(feature.Reviews) != 2 || feature.Reviews[0].GetBody() != "please fix" || feature.Reviews[1].GetState() != "APPROVED" {
+		t.Fatal("Reviews of all pages were not stored: ", feature.Reviews)
+	}
+	if len(feature.RequestedReviewers) != 2 || feature.RequestedReviewers[1].GetLogin() != "bob" ||
+		len(feature.RequestedTeams) != 1 || feature.RequestedTeams[0].GetSlug() != "core" {
+		t.Fatal("Requested reviewers of all pages were not stored: ", feature.RequestedReviewers, feature.RequestedTeams)
+	}
+
+	if fix := pulls[1]; len(fix.RequestedReviewers) != 1 || fix.RequestedReviewers[0].GetLogin() != "carol" {
+		t.Fatal("Requested reviewers returned as a plain array were not stored: ", fix.RequestedReviewers)
+	}
+}
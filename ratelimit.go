@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions used by the Github rate limiter.
+const (
+	DEFAULT_ABUSE_RETRY_AFTER = time.Minute
+	RATE_LIMIT_LOG_EVERY      = 100
+)
+
+// rateLimiter is shared by all Github API calls of a run. When the rate limit is exhausted or abuse detection
+// kicks in, all calls wait until Github allows them again instead of failing. The zero value is ready to use.
+type rateLimiter struct {
+	mu           sync.Mutex
+	blockedUntil time.Time
+	rate         github.Rate
+	calls        int
+}
+
+// wait will block until Github accepts calls again.
+func (r *rateLimiter) wait() {
+	r.mu.Lock()
+	until := r.blockedUntil
+	r.mu.Unlock()
+
+	if delay := until.Sub(time.Now()); delay > 0 {
+		fmt.Printf("[~] Github rate limit reached, sleeping until %s.\n", until.Format(time.RFC3339))
+		time.Sleep(delay)
+	}
+}
+
+// block will make all calls wait until given time.
+func (r *rateLimiter) block(until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until.After(r.blockedUntil) {
+		r.blockedUntil = until
+	}
+}
+
+// observe will update the known rate limit from a finished call. It returns true if the call was rejected by
+// a rate limit and should be repeated once the limiter allows it.
+func (r *rateLimiter) observe(resp *github.Response, err error) bool {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		r.block(e.Rate.Reset.Time)
+		return true
+	case *github.AbuseRateLimitError:
+		retryAfter := DEFAULT_ABUSE_RETRY_AFTER
+		if e.RetryAfter != nil {
+			retryAfter = *e.RetryAfter
+		}
+		r.block(time.Now().Add(retryAfter))
+		return true
+	}
+
+	if resp == nil || resp.Rate.Limit == 0 {
+		return false
+	}
+
+	r.mu.Lock()
+	r.rate = resp.Rate
+	r.calls++
+	logBudget := r.calls%RATE_LIMIT_LOG_EVERY == 0
+	r.mu.Unlock()
+
+	if logBudget {
+		fmt.Printf("[+] Github API budget: %d/%d remaining, resets at %s.\n",
+			resp.Rate.Remaining, resp.Rate.Limit, resp.Rate.Reset.Format(time.RFC3339))
+	}
+	if resp.Rate.Remaining == 0 {
+		r.block(resp.Rate.Reset.Time)
+	}
+	return false
+}
+
+// remaining will return the last known Github rate limit.
+func (r *rateLimiter) remaining() github.Rate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
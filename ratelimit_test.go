@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestCallGithubWaitsForRateLimitReset(t *testing.T) {
+	backup := &GithubBackup{config: &Config{}}
+	reset := time.Now().Add(50 * time.Millisecond)
+
+	calls := 0
+	resp, err := backup.callGithub("camunda", func() (*github.Response, error) {
+		calls++
+		if calls == 1 {
+			return nil, &github.RateLimitError{Rate: github.Rate{Limit: 5000, Reset: github.Timestamp{Time: reset}}}
+		}
+		rate := github.Rate{Limit: 5000, Remaining: 4999, Reset: github.Timestamp{Time: reset.Add(time.Hour)}}
+		return &github.Response{Response: &http.Response{}, Rate: rate}, nil
+	})
+
+	if err != nil || resp == nil || calls != 2 {
+		t.Fatal("Rate limited call was not repeated: ", calls, err)
+	}
+	if time.Now().Before(reset) {
+		t.Fatal("Call was repeated before the rate limit reset.")
+	}
+	if backup.rateLimit.remaining().Remaining != 4999 {
+		t.Fatal("Remaining budget was not recorded: ", backup.rateLimit.remaining())
+	}
+}
+
+func TestRateLimiterHonoursRetryAfter(t *testing.T) {
+	var limiter rateLimiter
+	retryAfter := 30 * time.Millisecond
+
+	if !limiter.observe(nil, &github.AbuseRateLimitError{RetryAfter: &retryAfter}) {
+		t.Fatal("Abuse detection response was not recognised.")
+	}
+	if limiter.observe(nil, errors.New("502 Bad Gateway")) {
+		t.Fatal("Other failure was treated as rate limit.")
+	}
+
+	start := time.Now()
+	limiter.wait()
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("Retry-After was not honoured.")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-github/github"
+)
+
+// releaseBackup is a single release together with its assets, as stored in the releases manifest.
+type releaseBackup struct {
+	Release *github.RepositoryRelease `json:"release"`
+	Assets  []*github.ReleaseAsset    `json:"assets"`
+}
+
+// getReleases will fetch all releases of a repository, including drafts and pre-releases.
+func (app *GithubBackup) getReleases(owner, name string) ([]*github.RepositoryRelease, error) {
+	opt := &github.ListOptions{PerPage: 100}
+
+	var allReleases []*github.RepositoryRelease
+	for {
+		var releases []*github.RepositoryRelease
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			releases, resp, err = app.clientFor(owner).Repositories.ListReleases(app.context, owner, name, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allReleases = append(allReleases, releases...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return allReleases, nil
+}
+
+// getReleaseAssets will fetch all assets of a single release.
+func (app *GithubBackup) getReleaseAssets(owner, name string, id int) ([]*github.ReleaseAsset, error) {
+	opt := &github.ListOptions{PerPage: 100}
+
+	var allAssets []*github.ReleaseAsset
+	for {
+		var assets []*github.ReleaseAsset
+		resp, err := app.callGithub(owner+"/"+name, func() (resp *github.Response, err error) {
+			assets, resp, err = app.clientFor(owner).Repositories.ListReleaseAssets(app.context, owner, name, id, opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		allAssets = append(allAssets, assets...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return allAssets, nil
+}
+
+// openReleaseAsset will open a download stream of a release asset, following the redirect to the storage
+// GitHub keeps the binaries in. It is the caller's responsibility to close the stream. The API call waits for the
+// rate limit like all others; the client does not hand out the response, so the remaining budget is not updated.
+func (app *GithubBackup) openReleaseAsset(owner, name string, id int) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var redirectURL string
+	_, err := app.callGithub(owner+"/"+name, func() (*github.Response, error) {
+		var err error
+		rc, redirectURL, err = app.clientFor(owner).Repositories.DownloadReleaseAsset(app.context, owner, name, id)
+		return nil, err
+	})
+	if err != nil || rc != nil {
+		return rc, err
+	}
+
+	resp, err := http.Get(redirectURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading release asset %d failed with status %s", id, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// backupReleaseAsset will download a single release asset and upload it under given key. Assets bigger than
+// configured threshold are streamed directly to the storage without touching the local disk.
+func (app *GithubBackup) backupReleaseAsset(owner, name string, asset *github.ReleaseAsset, key string) error {
+	body, err := app.openReleaseAsset(owner, name, asset.GetID())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if int64(asset.GetSize()) > app.config.StreamThresholdMB*1024*1024 {
+		app.uploadLimit.acquire()
+		defer app.uploadLimit.release()
+		return inPhase(PHASE_UPLOAD, app.put(key, body))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(key), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(key)
+
+	_, err = io.Copy(file, body)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return app.uploadFile(key)
+}
+
+// backupReleases will upload all release assets of a repository under <repo>/releases/<tag>/ together with
+// a releases.json manifest holding release notes, tags and draft/prerelease flags.
+func (app *GithubBackup) backupReleases(repo *github.Repository, repoPath string) error {
+	owner, name := *repo.Owner.Login, *repo.Name
+	releases, err := app.getReleases(owner, name)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return nil
+	}
+	fmt.Printf("[+] Backing up %d releases of %s.\n", len(releases), *repo.FullName)
+
+	releasesPath := filepath.Join(repoPath, "releases")
+	backup := make([]releaseBackup, 0, len(releases))
+	for _, release := range releases {
+		assets, err := app.getReleaseAssets(owner, name, release.GetID())
+		if err != nil {
+			return err
+		}
+
+		for _, asset := range assets {
+			key := filepath.Join(releasesPath, release.GetTagName(), asset.GetName())
+			err := app.retry(app.config.Retry.Storage, key, func() error {
+				return app.backupReleaseAsset(owner, name, asset, key)
+			})
+			if err != nil {
+				return describe(err, "asset %s of release %s", asset.GetName(), release.GetTagName())
+			}
+		}
+		backup = append(backup, releaseBackup{Release: release, Assets: assets})
+	}
+
+	manifestFile := filepath.Join(releasesPath, "releases.json")
+	if err := writeJSON(manifestFile, backup); err != nil {
+		return err
+	}
+	defer os.RemoveAll(releasesPath)
+
+	return app.uploadFile(manifestFile)
+}
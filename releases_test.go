@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackupReleases(t *testing.T) {
+	server := newFakeGithub(t, map[string][]string{
+		"/repos/camunda/repo/releases": {
+			`[{"id": 1, "tag_name": "v1.0", "name": "First", "body": "notes"}]`,
+			`[{"id": 2, "tag_name": "v2.0", "prerelease": true}]`,
+		},
+		"/repos/camunda/repo/releases/1/assets": {
+			`[{"id": 11, "name": "small.zip", "size": 5}]`,
+			`[{"id": 12, "name": "big.zip", "size": 2097152}]`,
+		},
+		"/repos/camunda/repo/releases/2/assets":  {`[]`},
+		"/repos/camunda/repo/releases/assets/11": {"small"},
+		"/repos/camunda/repo/releases/assets/12": {"streamed"},
+	})
+	defer server.Close()
+
+	backup, storage, cleanup := newFakeGithubBackup(server)
+	defer cleanup()
+
+	checkErr(backup.backupReleases(fakeRepository(), "snap/camunda/repo"))
+
+	for key, expected := range map[string]string{
+		"snap/camunda/repo/releases/v1.0/small.zip": "small",
+		"snap/camunda/repo/releases/v1.0/big.zip":   "streamed",
+	} {
+		body, err := storage.Get(key)
+		if err != nil {
+			t.Fatalf("Asset %s was not stored: %s", key, err)
+		}
+		content, err := ioutil.ReadAll(body)
+		body.Close()
+		checkErr(err)
+		if string(content) != expected {
+			t.Errorf("Asset %s holds %q, expected %q", key, content, expected)
+		}
+	}
+
+	var releases []releaseBackup
+	readStoredJSON(t, storage, "snap/camunda/repo/releases/releases.json", &releases)
+	if len(releases) != 2 || releases[0].Release.GetBody() != "notes" || !releases[1].Release.GetPrerelease() {
+		t.Fatal("Releases of all pages were not stored: ", releases)
+	}
+	if assets := releases[0].Assets; len(assets) != 2 || assets[0].GetName() != "small.zip" || assets[1].GetName() != "big.zip" {
+		t.Fatal("Assets of all pages were not recorded: ", assets)
+	}
+}
+
+func TestReleaseAssetDownloadWaitsForRateLimit(t *testing.T) {
+	server := newFakeGithub(t, map[string][]string{
+		"/repos/camunda/repo/releases/assets/11": {"asset"},
+	})
+	defer server.Close()
+
+	reset := time.Now().Add(time.Second)
+	limited := true
+	assets := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited {
+			limited = false
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "API rate limit exceeded for 127.0.0.1."}`)
+			return
+		}
+		assets.ServeHTTP(w, r)
+	})
+
+	backup, _, cleanup := newFakeGithubBackup(server)
+	defer cleanup()
+
+	body, err := backup.openReleaseAsset("camunda", "repo", 11)
+	if err != nil {
+		t.Fatal("Rate limited download was not repeated: ", err)
+	}
+	content, err := ioutil.ReadAll(body)
+	body.Close()
+	checkErr(err)
+	if string(content) != "asset" || time.Now().Before(reset.Truncate(time.Second)) {
+		t.Fatal("Download did not wait for the rate limit reset: ", string(content))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// constants definitions of backup and verification phases errors are reported for.
+const (
+	PHASE_LIST     = "list"
+	PHASE_CLONE    = "clone"
+	PHASE_EXPORT   = "export"
+	PHASE_COMPRESS = "compress"
+	PHASE_UPLOAD   = "upload"
+	PHASE_CLEANUP  = "cleanup"
+
+	PHASE_CHECKSUM = "checksum"
+	PHASE_UNPACK   = "unpack"
+	PHASE_FSCK     = "fsck"
+)
+
+// phaseError is an error annotated with the backup phase it happened in.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+// inPhase will annotate err with a backup phase, unless it was already annotated by a more specific caller.
+func inPhase(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*phaseError); ok {
+		return err
+	}
+	return &phaseError{phase, err}
+}
+
+// describe will prefix the message of err while keeping its phase annotation.
+func describe(err error, format string, args ...interface{}) error {
+	described := fmt.Errorf("%s: %s", fmt.Sprintf(format, args...), err)
+	if annotated, ok := err.(*phaseError); ok {
+		return &phaseError{annotated.phase, described}
+	}
+	return described
+}
+
+// backupFailure is a single failure of a repository, organisation or object in one phase.
+type backupFailure struct {
+	Name  string
+	Phase string
+	Err   error
+}
+
+// runReport collects failures of a backup run so it can continue and summarise them at the end.
+// The zero value is ready to use.
+type runReport struct {
+	mu           sync.Mutex
+	repositories int
+	failures     []backupFailure
+	attempts     map[string]int
+}
+
+// fail will log and record a failure of the named repository, organisation or object.
+func (r *runReport) fail(name string, err error) {
+	phase := "unknown"
+	if annotated, ok := err.(*phaseError); ok {
+		phase = annotated.phase
+	}
+	fmt.Printf("[!] %s failed in %s phase: %s\n", name, phase, err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, backupFailure{name, phase, err})
+}
+
+// attempted will record how many attempts an operation on the named repository or object needed. Only operations
+// which had to be retried are kept.
+func (r *runReport) attempted(name string, attempts int) {
+	if attempts <= 1 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attempts == nil {
+		r.attempts = map[string]int{}
+	}
+	if attempts > r.attempts[name] {
+		r.attempts[name] = attempts
+	}
+}
+
+// processed will count a repository the backup went through, successfully or not.
+func (r *runReport) processed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.repositories++
+}
+
+// err will return an error describing the number of failures, or nil if the run was successful.
+func (r *runReport) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("backup finished with %d failures", len(r.failures))
+}
+
+// printSummary will write a table of all failures ordered by name and phase.
+func (r *runReport) printSummary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "############################################################################")
+	fmt.Fprintf(w, "[+] Processed %d repositories, %d failures, %d retried.\n", r.repositories, len(r.failures), len(r.attempts))
+
+	if len(r.attempts) > 0 {
+		var names []string
+		for name := range r.attempts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "NAME\tATTEMPTS")
+		for _, name := range names {
+			fmt.Fprintf(table, "%s\t%d\n", name, r.attempts[name])
+		}
+		table.Flush()
+	}
+
+	if len(r.failures) == 0 {
+		return
+	}
+
+	sort.SliceStable(r.failures, func(i, j int) bool {
+		if r.failures[i].Name != r.failures[j].Name {
+			return r.failures[i].Name < r.failures[j].Name
+		}
+		return r.failures[i].Phase < r.failures[j].Phase
+	})
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tPHASE\tERROR")
+	for _, failure := range r.failures {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", failure.Name, failure.Phase, failure.Err)
+	}
+	table.Flush()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	var report runReport
+	report.processed()
+	report.processed()
+	if report.err() != nil {
+		t.Fatal("Successful run reported an error.")
+	}
+
+	uploadErr := inPhase(PHASE_UPLOAD, errors.New("AccessDenied"))
+	report.fail("camunda/zeebe", inPhase(PHASE_CLONE, describe(uploadErr, "asset %s", "zeebe.jar")))
+	report.fail("camunda", inPhase(PHASE_LIST, errors.New("502 Bad Gateway")))
+	if report.err() == nil {
+		t.Fatal("Failed run did not report an error.")
+	}
+
+	var out bytes.Buffer
+	report.printSummary(&out)
+	summary := out.String()
+	if !strings.Contains(summary, "Processed 2 repositories, 2 failures, 0 retried.") {
+		t.Fatal("Wrong summary header: ", summary)
+	}
+	if !strings.Contains(summary, "camunda/zeebe  upload  asset zeebe.jar: AccessDenied") {
+		t.Fatal("Phase of the failure was lost: ", summary)
+	}
+	if strings.Index(summary, "camunda  ") > strings.Index(summary, "camunda/zeebe") {
+		t.Fatal("Failures are not sorted: ", summary)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// restoreOptions selects what should be restored and where to.
+type restoreOptions struct {
+	Snapshot     string
+	Organisation string
+	Pattern      string
+	Target       string
+	Dir          string
+	Prune        bool
+}
+
+// restoreArtifacts are the objects of a single repository in a snapshot. Bundles are ordered by their position
+// in the chain, the full bundle first. Refs are the ref tips recorded in the manifest, if there is one.
+type restoreArtifacts struct {
+	Tarball string
+	Bundles []string
+	Refs    map[string]string
+}
+
+// runRestore is the entry point of the restore subcommand.
+func runRestore(args []string) {
+	var opts restoreOptions
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&opts.Snapshot, "snapshot", "", "timestamp of the snapshot to restore, e.g. "+DATETIME_LAYOUT)
+	flags.StringVar(&opts.Organisation, "org", "", "organisation to restore repositories of")
+	flags.StringVar(&opts.Pattern, "repo", "*", "glob pattern of repository names to restore")
+	flags.StringVar(&opts.Target, "target", "", "remote to push the mirrors to, {repo} is replaced by the repository name")
+	flags.StringVar(&opts.Dir, "dir", "restore", "local directory to unpack the mirrors into")
+	flags.BoolVar(&opts.Prune, "prune", false, "delete branches and tags of the target which are not in the backup")
+	flags.Parse(args)
+
+	if _, err := ParseTime(opts.Snapshot); err != nil || len(opts.Organisation) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := NewGithubBackup().restore(&opts); err != nil {
+		fmt.Println("[!] restore failed: ", err)
+		os.Exit(1)
+	}
+}
+
+// parseArtifactKey will split the name of an object stored directly under the organisation prefix into the
+// repository name and the position in the bundle chain. Position -1 means tarball; ok is false for other objects.
+func parseArtifactKey(name string) (repo string, position int, ok bool) {
+	if repo, _, ok := splitArchiveKey(name); ok {
+		return repo, -1, true
+	}
+	if !strings.HasSuffix(name, ".bundle") {
+		return "", 0, false
+	}
+
+	repo = strings.TrimSuffix(name, ".bundle")
+	if dot := strings.LastIndex(repo, "."); dot > 0 {
+		if n, err := strconv.Atoi(repo[dot+1:]); err == nil {
+			return repo[:dot], n, true
+		}
+	}
+	return repo, 0, true
+}
+
+// snapshotKeys will return keys of the objects of the organisation in the snapshot as recorded in its manifest,
+// together with the ref tips recorded for each repository. Snapshots written before manifests existed are listed
+// from the storage instead and have no refs.
+func (app *GithubBackup) snapshotKeys(snapshot, organisation string) ([]string, map[string]map[string]string, error) {
+	manifest, err := app.loadManifest(snapshot)
+	if err == errObjectNotFound {
+		fmt.Printf("[~] snapshot %s has no manifest, listing the storage.\n", snapshot)
+		objects, err := app.storage.List(fmt.Sprintf("%s/%s/", snapshot, organisation))
+		if err != nil {
+			return nil, nil, err
+		}
+		var keys []string
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		return keys, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read manifest of snapshot %s: %s", snapshot, err)
+	}
+
+	if !manifest.Complete {
+		fmt.Printf("[!] snapshot %s is incomplete, the backup did not finish or some repositories failed.\n", snapshot)
+	}
+	var keys []string
+	refs := map[string]map[string]string{}
+	for _, repo := range manifest.Repositories {
+		if repo.Organisation != organisation {
+			continue
+		}
+		refs[repo.Name] = repo.Refs
+		if repo.Status != STATUS_OK {
+			fmt.Printf("[!] backup of %s/%s failed: %s\n", organisation, repo.Name, strings.Join(repo.Errors, "; "))
+		}
+		for _, artifact := range repo.Artifacts {
+			keys = append(keys, artifact.Key)
+		}
+	}
+	return keys, refs, nil
+}
+
+// findArtifacts will group the artifacts of repositories in the snapshot matching the pattern. Wikis are restored as
+// separate repositories named <repo>.wiki.
+func (app *GithubBackup) findArtifacts(opts *restoreOptions) (map[string]*restoreArtifacts, error) {
+	keys, refs, err := app.snapshotKeys(opts.Snapshot, opts.Organisation)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := groupArtifacts(fmt.Sprintf("%s/%s/", opts.Snapshot, opts.Organisation), keys, opts.Pattern)
+	for repo, repoArtifacts := range artifacts {
+		repoArtifacts.Refs = refs[repo]
+	}
+	return artifacts, nil
+}
+
+// groupArtifacts will group keys of objects stored directly under prefix by repositories matching the pattern.
+func groupArtifacts(prefix string, keys []string, pattern string) map[string]*restoreArtifacts {
+	positions := map[string]map[int]string{}
+	artifacts := map[string]*restoreArtifacts{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		repo, position, ok := parseArtifactKey(name)
+		if !ok {
+			continue
+		}
+		if matched, err := filepath.Match(pattern, repo); err != nil || !matched {
+			continue
+		}
+
+		if artifacts[repo] == nil {
+			artifacts[repo] = &restoreArtifacts{}
+			positions[repo] = map[int]string{}
+		}
+		if position < 0 {
+			artifacts[repo].Tarball = key
+		} else {
+			positions[repo][position] = key
+		}
+	}
+
+	for repo, chain := range positions {
+		var order []int
+		for position := range chain {
+			order = append(order, position)
+		}
+		sort.Ints(order)
+		for _, position := range order {
+			artifacts[repo].Bundles = append(artifacts[repo].Bundles, chain[position])
+		}
+	}
+	return artifacts
+}
+
+// extract will unpack a tarball into the target directory.
+func extract(r io.Reader, target string) error {
+	tarball := tar.NewReader(r)
+	for {
+		header, err := tarball.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(target, header.Name)
+		if !strings.HasPrefix(path, filepath.Clean(target)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal path in tarball: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tarball)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// download will save the object stored under key into a file.
+func (app *GithubBackup) download(key, path string) error {
+	body, err := app.get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// unpackTarball will restore a bare mirror from a tarball into dir/<repo>.
+func (app *GithubBackup) unpackTarball(key, dir string) error {
+	body, err := app.get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tarball, err := decompress(key, body)
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+	return extract(tarball, dir)
+}
+
+// unpackBundles will restore a bare mirror into repoPath by cloning the full bundle and fetching the
+// incremental ones in order. Refs may move non-fast-forward between bundles, e.g. refs/pull/*/head on every
+// force-push, so they are fetched forcibly. An incremental bundle holds only refs with new commits, so deleted refs
+// are pruned by the recorded refs instead of the last bundle.
+func (app *GithubBackup) unpackBundles(keys []string, refs map[string]string, repoPath string) error {
+	tmpDir, err := ioutil.TempDir("", "ghbackup-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, key := range keys {
+		bundlePath := filepath.Join(tmpDir, fmt.Sprintf("%d.bundle", i))
+		if err := app.download(key, bundlePath); err != nil {
+			return err
+		}
+
+		cmd := exec.Command("git", "-C", repoPath, "fetch", "-q", bundlePath, "+refs/*:refs/*")
+		if i == 0 {
+			cmd = exec.Command("git", "clone", "-q", "--mirror", bundlePath, repoPath)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, output)
+		}
+	}
+	if err := exec.Command("git", "-C", repoPath, "remote", "rm", "origin").Run(); err != nil {
+		return err
+	}
+	if refs == nil {
+		return nil
+	}
+	return resetRefs(repoPath, refs)
+}
+
+// resetRefs will point the refs of a mirror to the recorded tips, deleting the refs which were not recorded.
+func resetRefs(repoPath string, refs map[string]string) error {
+	current, err := listRefs(repoPath)
+	if err != nil {
+		return err
+	}
+
+	var commands bytes.Buffer
+	for ref := range current {
+		if _, ok := refs[ref]; !ok {
+			fmt.Fprintf(&commands, "delete %s\n", ref)
+		}
+	}
+	for ref, sha := range refs {
+		if current[ref] != sha {
+			fmt.Fprintf(&commands, "update %s %s\n", ref, sha)
+		}
+	}
+	if commands.Len() == 0 {
+		return nil
+	}
+
+	cmd := exec.Command("git", "-C", repoPath, "update-ref", "--stdin")
+	cmd.Stdin = &commands
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot reset refs to the recorded tips: %s: %s", err, output)
+	}
+	return nil
+}
+
+// RESTORE_REFSPECS are the refs pushed to the restore target. The mirror also holds refs GitHub keeps to itself, e.g.
+// refs/pull/*, which GitHub refuses as hidden refs, so only branches and tags are pushed.
+var RESTORE_REFSPECS = []string{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"}
+
+// restoreRepository will unpack a single repository and push it to the target remote if one is given. Branches and
+// tags of the target missing in the backup are only deleted with -prune.
+func (app *GithubBackup) restoreRepository(repo string, artifacts *restoreArtifacts, opts *restoreOptions) error {
+	repoPath := filepath.Join(opts.Dir, repo)
+	if _, err := os.Stat(repoPath); err == nil {
+		return fmt.Errorf("%s already exists", repoPath)
+	}
+
+	var err error
+	if len(artifacts.Bundles) > 0 {
+		err = app.unpackBundles(artifacts.Bundles, artifacts.Refs, repoPath)
+	} else {
+		err = app.unpackTarball(artifacts.Tarball, opts.Dir)
+	}
+	if err != nil || len(opts.Target) == 0 {
+		return err
+	}
+
+	remote := strings.Replace(opts.Target, "{repo}", repo, -1)
+	fmt.Printf("[+] Pushing %s to %s.\n", repo, remote)
+	args := []string{"-C", repoPath, "push", remote}
+	if opts.Prune {
+		args = append(args, "--prune")
+	}
+	args = append(args, RESTORE_REFSPECS...)
+	if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git push: %s: %s", err, output)
+	}
+	return nil
+}
+
+// restore will recreate repositories of an organisation from a backup snapshot.
+func (app *GithubBackup) restore(opts *restoreOptions) error {
+	artifacts, err := app.findArtifacts(opts)
+	if err != nil {
+		return err
+	}
+	if len(artifacts) == 0 {
+		return fmt.Errorf("no repositories matching %q found in snapshot %s/%s", opts.Pattern, opts.Snapshot, opts.Organisation)
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return err
+	}
+
+	var failed int
+	for repo, repoArtifacts := range artifacts {
+		fmt.Printf("[+] Restoring %s/%s from %s.\n", opts.Organisation, repo, opts.Snapshot)
+		if err := app.restoreRepository(repo, repoArtifacts, opts); err != nil {
+			fmt.Printf("[!] cannot restore %s: %s\n", repo, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories failed", failed, len(artifacts))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestParseArtifactKey(t *testing.T) {
+	cases := []struct {
+		name     string
+		repo     string
+		position int
+		ok       bool
+	}{
+		{"repo.tar", "repo", -1, true},
+		{"repo.wiki.tar", "repo.wiki", -1, true},
+		{"repo.tar.gz", "repo", -1, true},
+		{"repo.wiki.tar.zst", "repo.wiki", -1, true},
+		{"repo.bundle", "repo", 0, true},
+		{"repo.3.bundle", "repo", 3, true},
+		{"bpmn.io.bundle", "bpmn.io", 0, true},
+		{"repo.issues.json", "", 0, false},
+	}
+
+	for _, c := range cases {
+		repo, position, ok := parseArtifactKey(c.name)
+		if repo != c.repo || position != c.position || ok != c.ok {
+			t.Errorf("parseArtifactKey(%q) = %q, %d, %t", c.name, repo, position, ok)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	checkErr(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+	backup := &GithubBackup{config: &Config{Format: FORMAT_BUNDLE, BundleFullEvery: 7, Compression: COMPRESSION_GZIP},
+		storage: storage}
+
+	git(t, ".", "init", "-q", "origin")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, "origin", "tag", "v1.0")
+	snapshot := "01-05-2017-12:00:00"
+
+	// GitHub mirrors hold pull request refs, which GitHub refuses to receive.
+	mirror := func(repo string) {
+		git(t, ".", "clone", "-q", "--mirror", "origin", snapshot+"/org/"+repo)
+		git(t, snapshot+"/org/"+repo, "update-ref", "refs/pull/1/head", "HEAD")
+	}
+
+	mirror("tarred")
+	checkErr(backup.archive(snapshot+"/org/tarred", snapshot+"/org/tarred.tar.gz"))
+
+	mirror("zstd")
+	backup.config.Compression = COMPRESSION_ZSTD
+	checkErr(backup.archive(snapshot+"/org/zstd", snapshot+"/org/zstd.tar.zst"))
+
+	// the pull request is force-pushed between the full and the incremental bundle
+	repo := &github.Repository{Name: github.String("bundled"), FullName: github.String("org/bundled")}
+	previous := "30-04-2017-12:00:00/org/bundled"
+	git(t, ".", "clone", "-q", "--mirror", "origin", previous)
+	git(t, previous, "update-ref", "refs/pull/1/head", "HEAD")
+	full, err := backup.uploadBundle(repo, previous, mirrorRefs(t, previous), nil)
+	checkErr(err)
+
+	mirror("bundled")
+	rewritten := git(t, snapshot+"/org/bundled", "commit-tree", "HEAD^{tree}", "-m", "rewritten")
+	git(t, snapshot+"/org/bundled", "update-ref", "refs/pull/1/head", rewritten)
+	incremental, err := backup.uploadBundle(repo, snapshot+"/org/bundled", mirrorRefs(t, snapshot+"/org/bundled"), full)
+	checkErr(err)
+	if len(incremental.Bundles) != 2 {
+		t.Fatal("Force-push was not bundled incrementally: ", incremental.Bundles)
+	}
+
+	for _, repo := range []string{"tarred", "zstd", "bundled"} {
+		git(t, ".", "init", "-q", "--bare", filepath.Join("target", repo))
+		git(t, filepath.Join("target", repo), "config", "receive.hideRefs", "refs/pull")
+		git(t, "origin", "push", "-q", filepath.Join("..", "target", repo), "HEAD:refs/heads/work")
+	}
+
+	opts := &restoreOptions{Snapshot: snapshot, Organisation: "org", Pattern: "*", Dir: "restored",
+		Target: filepath.Join(dir, "target", "{repo}")}
+	if err := backup.restore(opts); err != nil {
+		t.Fatal("Restore failed: ", err)
+	}
+
+	if mirrorRefs(t, "restored/bundled")["refs/pull/1/head"] != rewritten {
+		t.Fatal("Force-pushed ref was not restored.")
+	}
+
+	for _, repo := range []string{"tarred", "zstd", "bundled"} {
+		if git(t, filepath.Join("target", repo), "log", "--format=%s", "-1", "--all") != "first" {
+			t.Fatal("Repository was not pushed to target: ", repo)
+		}
+		refs := git(t, filepath.Join("target", repo), "for-each-ref", "--format=%(refname)")
+		if !strings.Contains(refs, "refs/tags/v1.0") || strings.Contains(refs, "refs/pull/") {
+			t.Fatal("Wrong refs pushed to target: ", refs)
+		}
+		if !strings.Contains(refs, "refs/heads/work") {
+			t.Fatal("Branch of target was deleted without prune: ", repo)
+		}
+	}
+
+	opts.Dir, opts.Prune = "pruned", true
+	if err := backup.restore(opts); err != nil {
+		t.Fatal("Restore with prune failed: ", err)
+	}
+	for _, repo := range []string{"tarred", "zstd", "bundled"} {
+		if refs := git(t, filepath.Join("target", repo), "for-each-ref", "--format=%(refname)"); strings.Contains(refs, "refs/heads/work") {
+			t.Fatal("Branch missing in the backup was not pruned: ", refs)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionConfig is a grandfather-father-son retention policy. Besides all snapshots younger than
+// keep_last_backup_days, the newest snapshot of each of the last Daily days, Weekly weeks, Monthly months and Yearly
+// years is kept, preferring complete snapshots. With DryRun the snapshots which would be pruned are only printed.
+type RetentionConfig struct {
+	Daily   int  `yaml:"daily"`
+	Weekly  int  `yaml:"weekly"`
+	Monthly int  `yaml:"monthly"`
+	Yearly  int  `yaml:"yearly"`
+	DryRun  bool `yaml:"dry_run"`
+}
+
+// backupSnapshot is a snapshot found in the storage together with all its objects. Complete and Finished are read
+// from its manifest.
+type backupSnapshot struct {
+	Name        string
+	CreatedAt   time.Time
+	Objects     []StoredObject
+	HasManifest bool
+	Complete    bool
+	Finished    bool
+}
+
+// preference will rank a snapshot when choosing the one kept for a period. Complete snapshots come first, then
+// finished ones and those created before manifests existed, whose state is unknown.
+func (s *backupSnapshot) preference() int {
+	switch {
+	case s.Complete:
+		return 2
+	case s.Finished || !s.HasManifest:
+		return 1
+	}
+	return 0
+}
+
+// parseSnapshot will parse the timestamp a snapshot is named after. Names which do not render back the same are
+// rejected, so that nothing but snapshots written by the backup is recognised.
+func parseSnapshot(name string) (time.Time, bool) {
+	createdAt, err := ParseTime(name)
+	return createdAt, err == nil && RenderTime(createdAt) == name
+}
+
+// snapshotName will return the snapshot a key belongs to. Only keys of the layout written by the backup, i.e.
+// <snapshot>/manifest.json and <snapshot>/<organisation>/..., are recognised.
+func snapshotName(key string) (string, time.Time, bool) {
+	segments := strings.SplitN(key, "/", 3)
+	if len(segments) < 2 || (len(segments) == 2 && segments[1] != MANIFEST_NAME) {
+		return "", time.Time{}, false
+	}
+	createdAt, ok := parseSnapshot(segments[0])
+	return segments[0], createdAt, ok
+}
+
+// listSnapshotObjects will list objects of all snapshots. Only prefixes named like snapshots are listed, state
+// records and anything else in the storage are never read.
+func (app *GithubBackup) listSnapshotObjects() ([]StoredObject, error) {
+	var prefixes []string
+	err := app.retry(app.config.Retry.Storage, "storage", func() (err error) {
+		prefixes, err = app.storage.ListPrefixes("")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []StoredObject
+	for _, prefix := range prefixes {
+		if _, ok := parseSnapshot(strings.TrimSuffix(prefix, "/")); !ok {
+			continue
+		}
+
+		var snapshotObjects []StoredObject
+		err := app.retry(app.config.Retry.Storage, prefix, func() (err error) {
+			snapshotObjects, err = app.storage.List(prefix)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, snapshotObjects...)
+	}
+	return objects, nil
+}
+
+// groupSnapshots will group objects by the snapshot they belong to, newest snapshot first. Keys of other objects,
+// e.g. state records or anything else stored in the bucket, are returned as skipped.
+func groupSnapshots(objects []StoredObject) (snapshots []*backupSnapshot, skipped []string) {
+	byName := map[string]*backupSnapshot{}
+	for _, obj := range objects {
+		name, createdAt, ok := snapshotName(obj.Key)
+		if !ok {
+			skipped = append(skipped, obj.Key)
+			continue
+		}
+
+		snapshot, ok := byName[name]
+		if !ok {
+			snapshot = &backupSnapshot{Name: name, CreatedAt: createdAt}
+			byName[name] = snapshot
+			snapshots = append(snapshots, snapshot)
+		}
+		snapshot.Objects = append(snapshot.Objects, obj)
+		snapshot.HasManifest = snapshot.HasManifest || obj.Key == manifestKey(name)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, skipped
+}
+
+// readManifests will mark snapshots complete and finished as their manifests record. Snapshots whose manifest cannot
+// be read are returned as unreadable, their state is unknown.
+func (app *GithubBackup) readManifests(snapshots []*backupSnapshot) (unreadable []string) {
+	for _, snapshot := range snapshots {
+		if !snapshot.HasManifest {
+			continue
+		}
+
+		manifest, err := app.loadManifest(snapshot.Name)
+		if err != nil {
+			fmt.Printf("[!] cannot read manifest of snapshot %s: %s\n", snapshot.Name, err)
+			unreadable = append(unreadable, snapshot.Name)
+			continue
+		}
+		snapshot.Complete = manifest.Complete
+		snapshot.Finished = manifest.FinishedAt != nil
+	}
+	return unreadable
+}
+
+// latestComplete will find the newest snapshot marked complete. Without any complete snapshot the newest one created
+// before manifests existed is returned. Snapshots must be ordered newest first and their manifests read.
+func latestComplete(snapshots []*backupSnapshot) string {
+	var legacy string
+	for _, snapshot := range snapshots {
+		if snapshot.Complete {
+			return snapshot.Name
+		}
+		if !snapshot.HasManifest && len(legacy) == 0 {
+			legacy = snapshot.Name
+		}
+	}
+	return legacy
+}
+
+// retentionPeriods maps the periods of the policy to the bucket a snapshot falls into.
+var retentionPeriods = []struct {
+	name   string
+	count  func(RetentionConfig) int
+	bucket func(time.Time) string
+}{
+	{"daily", func(p RetentionConfig) int { return p.Daily }, func(t time.Time) string { return t.Format("2006-01-02") }},
+	{"weekly", func(p RetentionConfig) int { return p.Weekly }, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{"monthly", func(p RetentionConfig) int { return p.Monthly }, func(t time.Time) string { return t.Format("2006-01") }},
+	{"yearly", func(p RetentionConfig) int { return p.Yearly }, func(t time.Time) string { return t.Format("2006") }},
+}
+
+// retain will decide which snapshots to keep and why. Snapshots must be ordered newest first. Each period keeps the
+// newest of its most preferred snapshots, so a failed backup at the end of a month does not replace a complete one.
+func (policy RetentionConfig) retain(snapshots []*backupSnapshot, keepDays int, now time.Time) map[string][]string {
+	keep := map[string][]string{}
+	for _, snapshot := range snapshots {
+		if int(now.Sub(snapshot.CreatedAt).Hours()) <= keepDays*24 {
+			keep[snapshot.Name] = append(keep[snapshot.Name], fmt.Sprintf("last %d days", keepDays))
+		}
+	}
+
+	for _, period := range retentionPeriods {
+		count := period.count(policy)
+		var buckets []string
+		chosen := map[string]*backupSnapshot{}
+		for _, snapshot := range snapshots {
+			bucket := period.bucket(snapshot.CreatedAt)
+			if best, ok := chosen[bucket]; ok {
+				if snapshot.preference() > best.preference() {
+					chosen[bucket] = snapshot
+				}
+				continue
+			}
+			if len(buckets) == count {
+				break
+			}
+			buckets = append(buckets, bucket)
+			chosen[bucket] = snapshot
+		}
+		for _, bucket := range buckets {
+			name := chosen[bucket].Name
+			keep[name] = append(keep[name], period.name)
+		}
+	}
+	return keep
+}
+
+// prune will delete all objects of a snapshot in batches, or only print it in dry run. The manifest is rewritten as
+// incomplete first and deleted last, so a snapshot which is only partly deleted is never taken for a complete one.
+// Keys which cannot be deleted are retried following the storage retry policy and reported one by one.
+func (app *GithubBackup) prune(snapshot *backupSnapshot) {
+	if app.config.Retention.DryRun {
+		fmt.Printf("[~] Dry run, would prune snapshot %s (%d objects).\n", snapshot.Name, len(snapshot.Objects))
+		return
+	}
+
+	fmt.Printf("[+] Pruning snapshot %s (%d objects).\n", snapshot.Name, len(snapshot.Objects))
+	if snapshot.HasManifest {
+		if err := app.invalidateManifest(snapshot.Name); err != nil {
+			app.report.fail(manifestKey(snapshot.Name), inPhase(PHASE_CLEANUP, err))
+			return
+		}
+	}
+
+	var keys []string
+	for _, obj := range snapshot.Objects {
+		if obj.Key != manifestKey(snapshot.Name) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	if app.deleteAll(snapshot.Name, keys) && snapshot.HasManifest {
+		app.deleteAll(snapshot.Name, []string{manifestKey(snapshot.Name)})
+	}
+}
+
+// invalidateManifest will rewrite the manifest of a snapshot marked complete as incomplete.
+func (app *GithubBackup) invalidateManifest(snapshot string) error {
+	manifest, err := app.loadManifest(snapshot)
+	if err != nil || !manifest.Complete {
+		return err
+	}
+
+	manifest.Complete = false
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return app.retry(app.config.Retry.Storage, manifestKey(snapshot), func() error {
+		return app.storage.Put(manifestKey(snapshot), bytes.NewReader(data), nil)
+	})
+}
+
+// deleteAll will delete given keys in batches, retrying the keys which could not be deleted and reporting them one
+// by one. It tells whether all keys were deleted.
+func (app *GithubBackup) deleteAll(name string, pending []string) bool {
+	var failed map[string]error
+	app.retry(app.config.Retry.Storage, name, func() error {
+		failed = app.storage.DeleteAll(pending)
+		pending = nil
+		var err error
+		for key, keyErr := range failed {
+			pending, err = append(pending, key), keyErr
+		}
+		return err
+	})
+
+	sort.Strings(pending)
+	for _, key := range pending {
+		app.report.fail(key, inPhase(PHASE_CLEANUP, failed[key]))
+	}
+	return len(pending) == 0
+}
+
+// runPrune is the entry point of the prune subcommand, which applies the retention policy without running a backup.
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print which snapshots would be pruned")
+	flags.Parse(args)
+
+	app := NewGithubBackup()
+	app.config.Retention.DryRun = app.config.Retention.DryRun || *dryRun
+	app.cleanup()
+	if err := app.report.err(); err != nil {
+		app.report.printSummary(os.Stdout)
+		fmt.Println("[!] prune failed: ", err)
+		os.Exit(1)
+	}
+}
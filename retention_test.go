@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)
+
+	// nightly snapshots for two years
+	var objects []StoredObject
+	for day := 0; day < 730; day++ {
+		objects = append(objects, StoredObject{Key: RenderTime(now.AddDate(0, 0, -day)) + "/org/repo.tar"})
+	}
+	snapshots, _ := groupSnapshots(objects)
+	if len(snapshots) != 730 || !snapshots[0].CreatedAt.Equal(now) {
+		t.Fatal("Snapshots were not grouped newest first.")
+	}
+
+	policy := RetentionConfig{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 3}
+	keep := policy.retain(snapshots, 0, now)
+
+	kept := map[string]int{}
+	for _, reasons := range keep {
+		for _, reason := range reasons {
+			kept[reason]++
+		}
+	}
+	if kept["daily"] != 7 || kept["weekly"] != 4 || kept["monthly"] != 12 || kept["yearly"] != 3 {
+		t.Fatal("Wrong number of snapshots kept: ", kept)
+	}
+
+	// the newest snapshot of every month is kept, i.e. the last day of past months
+	if reasons := keep[RenderTime(time.Date(2026, 3, 31, 2, 0, 0, 0, time.UTC))]; len(reasons) != 1 || reasons[0] != "monthly" {
+		t.Fatal("Monthly snapshot was not kept: ", reasons)
+	}
+	if _, ok := keep[RenderTime(time.Date(2026, 3, 30, 2, 0, 0, 0, time.UTC))]; ok {
+		t.Fatal("Snapshot in the middle of a month was kept.")
+	}
+
+	keep = RetentionConfig{}.retain(snapshots, 7, now)
+	if len(keep) != 8 {
+		t.Fatal("keep_last_backup_days was not honoured: ", len(keep))
+	}
+}
+
+func TestRetentionPrefersCompleteSnapshots(t *testing.T) {
+	now := time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)
+	snapshot := func(day int, complete, finished bool) *backupSnapshot {
+		createdAt := time.Date(2026, 9, day, 2, 0, 0, 0, time.UTC)
+		return &backupSnapshot{Name: RenderTime(createdAt), CreatedAt: createdAt, HasManifest: true,
+			Complete: complete, Finished: finished}
+	}
+
+	// September ends with an unfinished and a failed run, August only has an unfinished one
+	unfinished, failed, complete := snapshot(30, false, false), snapshot(29, false, true), snapshot(28, true, true)
+	older := snapshot(27, true, true)
+	august := &backupSnapshot{Name: "august", CreatedAt: time.Date(2026, 8, 31, 2, 0, 0, 0, time.UTC), HasManifest: true}
+	snapshots := []*backupSnapshot{unfinished, failed, complete, older, august}
+
+	keep := RetentionConfig{Monthly: 2}.retain(snapshots, 0, now)
+	if len(keep) != 2 || keep[complete.Name] == nil || keep["august"] == nil {
+		t.Fatal("Complete snapshot was not preferred: ", keep)
+	}
+
+	complete.Complete, older.Complete = false, false
+	keep = RetentionConfig{Monthly: 1}.retain(snapshots, 0, now)
+	if len(keep) != 1 || keep[failed.Name] == nil {
+		t.Fatal("Finished snapshot was not preferred: ", keep)
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+
+	old := RenderTime(time.Now().AddDate(0, 0, -10))
+	recent := RenderTime(time.Now().AddDate(0, 0, -1))
+	checkErr(storage.Put(old+"/org/repo.tar", strings.NewReader("old"), nil))
+	checkErr(storage.Put(recent+"/org/repo.tar", strings.NewReader("recent"), nil))
+
+	config := &Config{KeepLastBackupDays: 7, Retention: RetentionConfig{DryRun: true}}
+	backup := &GithubBackup{config: config, storage: storage, createdAt: RenderTime(time.Now())}
+	output := captureStdout(backup.cleanup)
+
+	if !strings.Contains(output, "would prune snapshot "+old) {
+		t.Fatal("Pruned snapshot was not printed: ", output)
+	}
+	if objects, _ := storage.List(""); len(objects) != 2 {
+		t.Fatal("Dry run deleted objects: ", objects)
+	}
+}
+
+// failingDeleteStorage refuses to delete one key.
+type failingDeleteStorage struct {
+	Storage
+	denied string
+}
+
+func (s failingDeleteStorage) DeleteAll(keys []string) map[string]error {
+	var allowed []string
+	for _, key := range keys {
+		if key != s.denied {
+			allowed = append(allowed, key)
+		}
+	}
+	failed := s.Storage.DeleteAll(allowed)
+	if len(allowed) < len(keys) {
+		failed[s.denied] = errors.New("access denied")
+	}
+	return failed
+}
+
+func TestPruneInvalidatesManifestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	local, err := newLocalStorage(dir)
+	checkErr(err)
+
+	old := RenderTime(time.Now().AddDate(0, 0, -30))
+	denied := old + "/org/denied.tar"
+	storage := failingDeleteStorage{Storage: local, denied: denied}
+	backup := &GithubBackup{config: &Config{}, storage: storage, createdAt: old}
+	backup.manifest = newManifestRecorder(old)
+	checkErr(backup.put(old+"/org/repo.tar", strings.NewReader("repo")))
+	checkErr(backup.put(denied, strings.NewReader("denied")))
+	checkErr(backup.writeManifest(true))
+
+	objects, err := backup.listSnapshotObjects()
+	checkErr(err)
+	snapshots, _ := groupSnapshots(objects)
+	backup.prune(snapshots[0])
+
+	manifest, err := backup.loadManifest(old)
+	if err != nil || manifest.Complete {
+		t.Fatal("Manifest of a partly pruned snapshot was not left incomplete: ", err)
+	}
+	if _, err := local.Get(old + "/org/repo.tar"); err != errObjectNotFound {
+		t.Fatal("Artifact was not deleted.")
+	}
+	if len(backup.report.failures) != 1 || backup.report.failures[0].Name != denied {
+		t.Fatal("Failed key was not reported: ", backup.report.failures)
+	}
+
+	storage.denied = ""
+	backup.storage = storage
+	objects, err = backup.listSnapshotObjects()
+	checkErr(err)
+	snapshots, _ = groupSnapshots(objects)
+	backup.prune(snapshots[0])
+	if objects, _ := local.List(""); len(objects) != 0 {
+		t.Fatal("Snapshot was not pruned completely: ", objects)
+	}
+}
+
+func TestCleanupOnlyDeletesSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(dir)
+	checkErr(err)
+	backup := &GithubBackup{config: &Config{KeepLastBackupDays: 7}, storage: storage, createdAt: RenderTime(time.Now())}
+
+	// an empty storage has nothing to clean up
+	backup.cleanup()
+	if err := backup.report.err(); err != nil {
+		t.Fatal("Cleanup of empty storage failed: ", err)
+	}
+
+	legacy := RenderTime(time.Now().AddDate(0, 0, -30))
+	older := RenderTime(time.Now().AddDate(0, 0, -40))
+	unreadable := RenderTime(time.Now().AddDate(0, 0, -50))
+	foreign := []string{"notes.txt", "other-tool/backup.tar", "31-02-2017-00:00:00/org/repo.tar", older + "/stray.tar",
+		STATE_PREFIX + "/org/repo.json"}
+	for _, key := range append(foreign, legacy+"/org/repo.tar", older+"/org/repo.tar", unreadable+"/org/repo.tar") {
+		checkErr(storage.Put(key, strings.NewReader(key), nil))
+	}
+	checkErr(storage.Put(manifestKey(unreadable), strings.NewReader("{"), nil))
+
+	backup.cleanup()
+
+	left := map[string]bool{}
+	objects, err := storage.List("")
+	checkErr(err)
+	for _, obj := range objects {
+		left[obj.Key] = true
+	}
+	for _, key := range append(foreign, legacy+"/org/repo.tar", unreadable+"/org/repo.tar") {
+		if !left[key] {
+			t.Fatal("Object was deleted: ", key)
+		}
+	}
+	if left[older+"/org/repo.tar"] {
+		t.Fatal("Old snapshot was not deleted.")
+	}
+}
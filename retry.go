@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// constants definitions of the default retry policy used for operations without configuration.
+const (
+	DEFAULT_RETRY_ATTEMPTS      = 3
+	DEFAULT_RETRY_INITIAL_DELAY = time.Second
+	DEFAULT_RETRY_MAX_DELAY     = 30 * time.Second
+)
+
+// RetryPolicy describes how often and how long to wait before an operation is tried again.
+type RetryPolicy struct {
+	Attempts     int           `yaml:"attempts"`
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+}
+
+// RetryConfig holds retry policies for every type of operation which can fail transiently.
+type RetryConfig struct {
+	Github  RetryPolicy `yaml:"github"`
+	Git     RetryPolicy `yaml:"git"`
+	Storage RetryPolicy `yaml:"storage"`
+}
+
+// setDefaults will fill in default values for policies which were not configured.
+func (c *RetryConfig) setDefaults() {
+	for _, policy := range []*RetryPolicy{&c.Github, &c.Git, &c.Storage} {
+		if policy.Attempts <= 0 {
+			policy.Attempts = DEFAULT_RETRY_ATTEMPTS
+		}
+		if policy.InitialDelay <= 0 {
+			policy.InitialDelay = DEFAULT_RETRY_INITIAL_DELAY
+		}
+		if policy.MaxDelay <= 0 {
+			policy.MaxDelay = DEFAULT_RETRY_MAX_DELAY
+		}
+	}
+}
+
+// delay will compute exponential backoff with jitter before given retry. The first retry has number 1.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.InitialDelay
+	for i := 1; i < retry && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	// Full jitter in the upper half keeps concurrent retries apart without making the wait too short.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// isRetryable will tell whether the operation may succeed when tried again. Missing objects and client errors
+// reported by Github are permanent.
+func isRetryable(err error) bool {
+	if annotated, ok := err.(*phaseError); ok {
+		err = annotated.err
+	}
+
+	switch e := err.(type) {
+	case *github.RateLimitError, *github.AbuseRateLimitError:
+		return true
+	case *github.ErrorResponse:
+		return e.Response == nil || e.Response.StatusCode >= http.StatusInternalServerError
+	}
+	return err != errRemoteNotFound && err != errObjectNotFound && err != errHostKeyRejected
+}
+
+// retry will run fn until it succeeds, fails permanently or the policy runs out of attempts. The number of attempts
+// needed is recorded in the run report under given name.
+func (app *GithubBackup) retry(policy RetryPolicy, name string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !isRetryable(err) || attempt >= policy.Attempts {
+			app.report.attempted(name, attempt)
+			return err
+		}
+
+		delay := policy.delay(attempt)
+		fmt.Printf("[~] attempt %d/%d of %s failed: %s, retrying in %s\n", attempt, policy.Attempts, name, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// callGithub will run a Github API call with the Github retry policy. Calls rejected by rate limits wait for
+// the limit to reset and are repeated without using up the attempts.
+func (app *GithubBackup) callGithub(name string, fn func() (*github.Response, error)) (*github.Response, error) {
+	var resp *github.Response
+	err := app.retry(app.config.Retry.Github, name, func() error {
+		for {
+			app.rateLimit.wait()
+
+			var err error
+			resp, err = fn()
+			if !app.rateLimit.observe(resp, err) {
+				return err
+			}
+		}
+	})
+	return resp, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestRetry(t *testing.T) {
+	backup := &GithubBackup{config: &Config{}}
+	policy := RetryPolicy{Attempts: 4, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	calls := 0
+	err := backup.retry(policy, "camunda/zeebe", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatal("Transient failure was not retried: ", calls, err)
+	}
+	if backup.report.attempts["camunda/zeebe"] != 3 {
+		t.Fatal("Wrong number of attempts recorded: ", backup.report.attempts)
+	}
+
+	calls = 0
+	err = backup.retry(policy, "camunda/deleted", func() error {
+		calls++
+		return errRemoteNotFound
+	})
+	if err != errRemoteNotFound || calls != 1 {
+		t.Fatal("Permanent failure was retried: ", calls)
+	}
+
+	calls = 0
+	backup.retry(policy, "camunda/broken", func() error {
+		calls++
+		return errors.New("502 Bad Gateway")
+	})
+	if calls != 4 {
+		t.Fatal("Wrong number of attempts before giving up: ", calls)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 8: 10 * time.Second} {
+		delay := policy.delay(retry)
+		if delay < max/2 || delay > max {
+			t.Errorf("Delay of retry %d out of range: %s", retry, delay)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	notFound := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	badGateway := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadGateway}}
+
+	if isRetryable(notFound) || isRetryable(inPhase(PHASE_CLONE, errObjectNotFound)) {
+		t.Fatal("Permanent failure is retryable.")
+	}
+	if !isRetryable(badGateway) || !isRetryable(&github.RateLimitError{}) {
+		t.Fatal("Transient failure is not retryable.")
+	}
+}
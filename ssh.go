@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/crypto/ssh"
+)
+
+// constants definitions of clone protocols and environment variables of the ssh program. In SSH mode the binary
+// itself acts as GIT_SSH program, loading the key and verifying host keys with golang.org/x/crypto/ssh.
+const (
+	CLONE_HTTPS = "https"
+	CLONE_SSH   = "ssh"
+
+	SSH_ENV             = "GHBACKUP_SSH"
+	SSH_KEY_ENV         = "GHBACKUP_SSH_KEY"
+	SSH_KNOWN_HOSTS_ENV = "GHBACKUP_SSH_KNOWN_HOSTS"
+	SSH_DEFAULT_USER    = "git"
+	SSH_DEFAULT_PORT    = "22"
+	SSH_HOST_KEY_FAILED = "Host key verification failed"
+)
+
+// SSHConfig holds the private key (deploy or machine key) and known_hosts file used in SSH clone mode.
+type SSHConfig struct {
+	PrivateKey string `yaml:"private_key"`
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// errHostKeyRejected is returned by mirror when the host key of the remote is unknown or does not match.
+var errHostKeyRejected = errors.New(strings.ToLower(SSH_HOST_KEY_FAILED))
+
+// cloneURL will return the URL repositories are cloned from in the configured protocol.
+func (app *GithubBackup) cloneURL(repo *github.Repository) string {
+	if app.config.CloneProtocol == CLONE_SSH {
+		return repo.GetSSHURL()
+	}
+	return repo.GetCloneURL()
+}
+
+// gitSSHCommand will create git command connecting over SSH with given configuration through the ssh program.
+func gitSSHCommand(config SSHConfig, args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(),
+		"GIT_SSH="+executable,
+		"GIT_SSH_VARIANT=ssh",
+		"GIT_TERMINAL_PROMPT=0",
+		SSH_ENV+"=1",
+		SSH_KEY_ENV+"="+config.PrivateKey,
+		SSH_KNOWN_HOSTS_ENV+"="+config.KnownHosts,
+	)
+	return cmd, nil
+}
+
+// loadSigner will read the private key used to authenticate over SSH.
+func loadSigner(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// knownHost is a single line of a known_hosts file.
+type knownHost struct {
+	patterns []string
+	key      ssh.PublicKey
+	revoked  bool
+}
+
+// loadKnownHosts will read all entries of a known_hosts file. Certificate authorities are not supported and skipped.
+func loadKnownHosts(path string) ([]knownHost, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []knownHost
+	for {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if marker != "cert-authority" {
+			entries = append(entries, knownHost{patterns: hosts, key: key, revoked: marker == "revoked"})
+		}
+		data = rest
+	}
+}
+
+// matchHost will check a host against a known_hosts pattern, which is either hashed (|1|salt|hash) or a hostname
+// with optional * and ? wildcards.
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	// [host]:port is not a character class
+	pattern = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(pattern)
+	matched, err := filepath.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return err == nil && matched
+}
+
+// knownHostsCallback will accept only host keys listed for the host in known_hosts. Unknown hosts, changed keys and
+// revoked keys are refused.
+func knownHostsCallback(entries []knownHost) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host, port, err := net.SplitHostPort(hostname)
+		if err != nil {
+			host, port = hostname, SSH_DEFAULT_PORT
+		}
+		if port != SSH_DEFAULT_PORT {
+			host = fmt.Sprintf("[%s]:%s", host, port)
+		}
+
+		known := false
+		for _, entry := range entries {
+			matches, negated := false, false
+			for _, pattern := range entry.patterns {
+				if strings.HasPrefix(pattern, "!") {
+					negated = negated || matchHost(pattern[1:], host)
+				} else {
+					matches = matches || matchHost(pattern, host)
+				}
+			}
+			if !matches || negated || !bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+				continue
+			}
+			if entry.revoked {
+				return fmt.Errorf("%s: %s key %s of %s is revoked", SSH_HOST_KEY_FAILED, key.Type(),
+					ssh.FingerprintSHA256(key), host)
+			}
+			known = true
+		}
+
+		if !known {
+			return fmt.Errorf("%s: %s key %s of %s is not in known_hosts", SSH_HOST_KEY_FAILED, key.Type(),
+				ssh.FingerprintSHA256(key), host)
+		}
+		return nil
+	}
+}
+
+// parseSSHArgs will split the arguments git passes to the ssh program, `[-o option] [-p port] [user@]host command`.
+func parseSSHArgs(args []string) (user, host, port, command string, err error) {
+	port = SSH_DEFAULT_PORT
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-p" && i+1 < len(args):
+			i++
+			port = args[i]
+		case args[i] == "-o" && i+1 < len(args):
+			i++ // options like SendEnv=GIT_PROTOCOL are handled by the session
+		case strings.HasPrefix(args[i], "-"):
+			// -4, -6 and alike do not change anything for us
+		case len(host) == 0:
+			host = args[i]
+		default:
+			command = strings.Join(args[i:], " ")
+			i = len(args)
+		}
+	}
+
+	if len(host) == 0 || len(command) == 0 {
+		return "", "", "", "", fmt.Errorf("unexpected ssh arguments %q", args)
+	}
+	user = SSH_DEFAULT_USER
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		user, host = host[:at], host[at+1:]
+	}
+	return user, host, port, command, nil
+}
+
+// sshCommand will run the command on the remote host and return its exit status. The connection authenticates with
+// the configured key and refuses host keys missing in known_hosts.
+func sshCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	user, host, port, command, err := parseSSHArgs(args)
+	if err != nil {
+		return 0, err
+	}
+
+	signer, err := loadSigner(os.Getenv(SSH_KEY_ENV))
+	if err != nil {
+		return 0, err
+	}
+	knownHosts, err := loadKnownHosts(os.Getenv(SSH_KNOWN_HOSTS_ENV))
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, port), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: knownHostsCallback(knownHosts),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	if protocol := os.Getenv("GIT_PROTOCOL"); len(protocol) > 0 {
+		session.Setenv("GIT_PROTOCOL", protocol) // servers may refuse, git falls back to protocol v0
+	}
+	session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+
+	if err := session.Run(command); err != nil {
+		if exit, ok := err.(*ssh.ExitError); ok {
+			return exit.ExitStatus(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// runSSH will run the remote command and exit with its status if the binary was started by git as ssh program.
+func runSSH() bool {
+	if len(os.Getenv(SSH_ENV)) == 0 {
+		return false
+	}
+
+	status, err := sshCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] ssh: %s\n", err)
+		os.Exit(255)
+	}
+	os.Exit(status)
+	return true
+}
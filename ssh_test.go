@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHKey will generate RSA key pair for tests.
+func newSSHKey() (*rsa.PrivateKey, ssh.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkErr(err)
+	signer, err := ssh.NewSignerFromKey(key)
+	checkErr(err)
+	return key, signer
+}
+
+// fakeSSHServer accepts sessions authenticated with given client key and runs their exec requests locally.
+func fakeSSHServer(hostKey ssh.Signer, clientKey ssh.PublicKey) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == SSH_DEFAULT_USER && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range channelRequests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+
+				length := binary.BigEndian.Uint32(req.Payload)
+				cmd := exec.Command("/bin/sh", "-c", string(req.Payload[4:4+length]))
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = channel, channel, channel.Stderr()
+				status := uint32(0)
+				if err := cmd.Run(); err != nil {
+					status = 1
+				}
+				channel.CloseWrite()
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+func TestSSHMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	git(t, dir, "init", "-q", "origin")
+	git(t, filepath.Join(dir, "origin"), "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, dir, "clone", "-q", "--bare", "origin", "remote/camunda/repo.git")
+
+	clientKey, clientSigner := newSSHKey()
+	_, hostSigner := newSSHKey()
+	_, otherSigner := newSSHKey()
+	server := fakeSSHServer(hostSigner, clientSigner.PublicKey())
+	defer server.Close()
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)})
+	checkErr(ioutil.WriteFile(keyPath, keyPEM, 0600))
+
+	port := server.Addr().(*net.TCPAddr).Port
+	knownHosts := filepath.Join(dir, "known_hosts")
+	writeKnownHost := func(key ssh.PublicKey) {
+		line := fmt.Sprintf("[127.0.0.1]:%d %s", port, ssh.MarshalAuthorizedKey(key))
+		checkErr(ioutil.WriteFile(knownHosts, []byte(line), 0600))
+	}
+
+	backup := &GithubBackup{config: &Config{
+		CloneProtocol: CLONE_SSH,
+		SSH:           SSHConfig{PrivateKey: keyPath, KnownHosts: knownHosts},
+		Retry:         RetryConfig{Git: RetryPolicy{Attempts: 3}},
+	}}
+	cloneUrl := fmt.Sprintf("ssh://git@127.0.0.1:%d%s/remote/camunda/repo.git", port, dir)
+	repoPath := filepath.Join(dir, "backup", "repo")
+
+	writeKnownHost(hostSigner.PublicKey())
+	if err := backup.mirror("camunda", "camunda/repo", cloneUrl, repoPath); err != nil {
+		t.Fatal("SSH clone failed: ", err)
+	}
+	if !strings.Contains(git(t, repoPath, "log", "--oneline", "--all"), "first") {
+		t.Fatal("Mirror does not contain the history.")
+	}
+
+	writeKnownHost(otherSigner.PublicKey())
+	if err := backup.mirror("camunda", "camunda/repo", cloneUrl, repoPath); err != errHostKeyRejected {
+		t.Fatal("Unknown host key was not refused: ", err)
+	}
+	if _, retried := backup.report.attempts["camunda/repo"]; retried {
+		t.Fatal("Refused host key was retried.")
+	}
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	_, signer := newSSHKey()
+	_, other := newSSHKey()
+	key := signer.PublicKey()
+
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("github.com"))
+	hashed := fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	callback := knownHostsCallback([]knownHost{
+		{patterns: []string{hashed}, key: key},
+		{patterns: []string{"*.example.com", "!evil.example.com"}, key: key},
+		{patterns: []string{"[git.example.org]:2222"}, key: key},
+		{patterns: []string{"revoked.example.org"}, key: key},
+		{patterns: []string{"revoked.example.org"}, key: key, revoked: true},
+	})
+
+	for _, host := range []string{"github.com:22", "ssh.example.com:22", "git.example.org:2222"} {
+		if err := callback(host, nil, key); err != nil {
+			t.Fatal("Known host was refused: ", host, err)
+		}
+	}
+	for _, host := range []string{"gitlab.com:22", "evil.example.com:22", "git.example.org:22", "revoked.example.org:22"} {
+		if err := callback(host, nil, key); err == nil {
+			t.Fatal("Host key was trusted: ", host)
+		}
+	}
+	if err := callback("github.com:22", nil, other.PublicKey()); err == nil {
+		t.Fatal("Changed host key was trusted.")
+	}
+}
+
+func TestParseSSHArgs(t *testing.T) {
+	user, host, port, command, err := parseSSHArgs([]string{
+		"-o", "SendEnv=GIT_PROTOCOL", "-p", "2222", "backup@github.com", "git-upload-pack 'camunda/repo.git'",
+	})
+	if err != nil || user != "backup" || host != "github.com" || port != "2222" ||
+		command != "git-upload-pack 'camunda/repo.git'" {
+		t.Fatal("Wrong ssh arguments: ", user, host, port, command, err)
+	}
+
+	user, _, port, _, _ = parseSSHArgs([]string{"github.com", "git-upload-pack 'camunda/repo.git'"})
+	if user != SSH_DEFAULT_USER || port != SSH_DEFAULT_PORT {
+		t.Fatal("Wrong ssh defaults: ", user, port)
+	}
+}
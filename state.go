@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// STATE_PREFIX is the key prefix under which per-repository state records are kept in the storage.
+const STATE_PREFIX = "state"
+
+// repositoryState records what was uploaded for a repository by the last successful backup. Bundles holds the
+// chain of git bundles in the snapshot, the full bundle first, and is only used with bundle format.
+type repositoryState struct {
+	PushedAt time.Time         `json:"pushed_at"`
+	Refs     map[string]string `json:"refs"`
+	Key      string            `json:"key"`
+	Format   string            `json:"format,omitempty"`
+	Bundles  []string          `json:"bundles,omitempty"`
+}
+
+// stateKey will return the storage key of the state record for given repository.
+func stateKey(repo *github.Repository) string {
+	return fmt.Sprintf("%s/%s.json", STATE_PREFIX, *repo.FullName)
+}
+
+// format will return the output format the state was recorded with. Older records are always tarballs.
+func (s *repositoryState) format() string {
+	if len(s.Format) == 0 {
+		return FORMAT_TAR
+	}
+	return s.Format
+}
+
+// unchanged will tell whether nothing was pushed to the repository since the state was recorded, judged by the
+// pushed_at of the API only. It is a cheap first check, refsUnchanged confirms it against the remote.
+func (s *repositoryState) unchanged(repo *github.Repository) bool {
+	return repo.PushedAt != nil && len(s.Key) > 0 && s.PushedAt.Equal(repo.PushedAt.Time)
+}
+
+// refsUnchanged will compare the ref tips recorded in the state with the tips of the remote, listed with
+// git ls-remote. pushed_at does not move for every ref update (e.g. pull request refs or force pushes through
+// some integrations), the ref tips do. Any problem listing the remote counts as changed.
+func (app *GithubBackup) refsUnchanged(repo *github.Repository, s *repositoryState) bool {
+	if len(s.Refs) == 0 {
+		return false
+	}
+
+	refs, err := app.remoteRefs(*repo.Owner.Login, app.cloneURL(repo))
+	if err != nil {
+		fmt.Printf("[!] cannot list refs of %s: %s\n", *repo.FullName, err)
+		return false
+	}
+	if len(refs) != len(s.Refs) {
+		return false
+	}
+	for ref, tip := range refs {
+		if s.Refs[ref] != tip {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteRefs will list the ref tips of a remote with the credentials of given organisation. HEAD and peeled tags
+// are left out, so the result matches listRefs of a mirror of the remote.
+func (app *GithubBackup) remoteRefs(organisation, cloneUrl string) (map[string]string, error) {
+	var output []byte
+	err := app.retry(app.config.Retry.Git, cloneUrl, func() error {
+		cmd, err := app.gitCommand(organisation, "ls-remote", cloneUrl)
+		if err != nil {
+			return err
+		}
+		output, err = cmd.Output()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/") && !strings.HasSuffix(fields[1], "^{}") {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// loadState will read the state record of a repository. It returns nil if the repository was never backed up.
+func (app *GithubBackup) loadState(repo *github.Repository) (*repositoryState, error) {
+	var body io.ReadCloser
+	err := app.retry(app.config.Retry.Storage, stateKey(repo), func() (err error) {
+		body, err = app.storage.Get(stateKey(repo))
+		return err
+	})
+	if err == errObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var state repositoryState
+	if err := json.NewDecoder(body).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveState will store the state record of a repository.
+func (app *GithubBackup) saveState(repo *github.Repository, state *repositoryState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return app.retry(app.config.Retry.Storage, stateKey(repo), func() error {
+		return app.storage.Put(stateKey(repo), bytes.NewReader(data), nil)
+	})
+}
+
+// previousState will read the state record of a repository, logging any problem. It returns nil if there is
+// no usable state.
+func (app *GithubBackup) previousState(repo *github.Repository) *repositoryState {
+	state, err := app.loadState(repo)
+	if err != nil {
+		fmt.Printf("[!] cannot read state of %s: %s\n", *repo.FullName, err)
+		return nil
+	}
+	return state
+}
+
+// reuseBackup will copy the artifacts of the last backup into the current snapshot. It returns the updated state
+// or an error if the repository has to be cloned again.
+func (app *GithubBackup) reuseBackup(repo *github.Repository, repoPath string, previous *repositoryState) (*repositoryState, error) {
+	state := *previous
+	if state.format() == FORMAT_BUNDLE {
+		state.Bundles = make([]string, len(previous.Bundles))
+		for i, key := range previous.Bundles {
+			state.Bundles[i] = bundleKey(repoPath, i)
+			err := app.retry(app.config.Retry.Storage, state.Bundles[i], func() error {
+				return app.copy(key, state.Bundles[i])
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		state.Key = state.Bundles[len(state.Bundles)-1]
+	} else {
+		_, extension, _ := splitArchiveKey(previous.Key) // the copy keeps the compression of the last backup
+		state.Key = repoPath + extension
+		err := app.retry(app.config.Retry.Storage, state.Key, func() error {
+			return app.copy(previous.Key, state.Key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.manifest.refs(repoPath, state.Refs)
+	fmt.Printf("[+] %s unchanged since last backup, reused %s.\n", *repo.FullName, previous.Key)
+	return &state, nil
+}
+
+// listRefs will read all ref tips of a cloned repository.
+func listRefs(repoPath string) (map[string]string, error) {
+	output, err := exec.Command("git", "-C", repoPath, "for-each-ref", "--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestReuseBackupOfUnchangedRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	checkErr(err)
+	checkErr(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	git(t, dir, "init", "-q", "origin")
+	git(t, filepath.Join(dir, "origin"), "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, dir, "clone", "-q", "--bare", "origin", "remote/org/repo.git")
+	server := fakeGitServer(t, filepath.Join(dir, "remote"), "backup", "secret")
+	defer server.Close()
+
+	refs, err := listRefs(filepath.Join(dir, "remote/org/repo.git"))
+	checkErr(err)
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+
+	pushedAt := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo := &github.Repository{
+		Name:     github.String("repo"),
+		FullName: github.String("org/repo"),
+		Owner:    &github.User{Login: github.String("org")},
+		CloneURL: github.String(server.URL + "/org/repo.git"),
+		PushedAt: &github.Timestamp{Time: pushedAt},
+	}
+
+	config := &Config{Incremental: true, Format: FORMAT_TAR, GithubAuth: AUTH_TOKEN, Username: "backup", Token: "secret"}
+	backup := &GithubBackup{config: config, storage: storage, createdAt: "today"}
+	checkErr(storage.Put("yesterday/org/repo.tar", strings.NewReader("mirror"), nil))
+	checkErr(backup.saveState(repo, &repositoryState{PushedAt: pushedAt, Refs: refs, Key: "yesterday/org/repo.tar"}))
+
+	if err := backup.cloneRepository(repo, "today/org/repo"); err != nil {
+		t.Fatal("Reusing previous backup failed: ", err)
+	}
+
+	body, err := storage.Get("today/org/repo.tar")
+	if err != nil {
+		t.Fatal("Previous backup was not reused: ", err)
+	}
+	content, err := ioutil.ReadAll(body)
+	body.Close()
+	checkErr(err)
+	if string(content) != "mirror" {
+		t.Fatal("Repository was cloned again instead of reused.")
+	}
+
+	state, err := backup.loadState(repo)
+	checkErr(err)
+	if state.Key != "today/org/repo.tar" {
+		t.Fatal("State was not updated: ", state.Key)
+	}
+
+	git(t, filepath.Join(dir, "remote/org/repo.git"), "update-ref", "refs/pull/1/head", "HEAD")
+	if !state.unchanged(repo) || backup.refsUnchanged(repo, state) {
+		t.Fatal("Ref updated without moving pushed_at was not detected.")
+	}
+
+	repo.PushedAt = &github.Timestamp{Time: pushedAt.Add(time.Hour)}
+	if state.unchanged(repo) {
+		t.Fatal("Pushed repository was reported as unchanged.")
+	}
+}
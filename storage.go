@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// constants definitions of supported storage backends.
+const (
+	STORAGE_S3    = "s3"
+	STORAGE_LOCAL = "local"
+)
+
+// StorageConfig selects and configures the backend backups are stored in.
+type StorageConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+
+	// Endpoint, PathStyle and CABundle are used to reach S3-compatible services such as MinIO or Ceph.
+	Endpoint  string `yaml:"endpoint"`
+	PathStyle bool   `yaml:"path_style"`
+	CABundle  string `yaml:"ca_bundle"`
+
+	// PartSizeMB and PartConcurrency tune multipart uploads to S3.
+	PartSizeMB      int `yaml:"part_size_mb"`
+	PartConcurrency int `yaml:"part_concurrency"`
+}
+
+// errObjectNotFound is returned by Storage when the requested key does not exist.
+var errObjectNotFound = errors.New("object not found")
+
+// StoredObject describes a single object kept in a Storage.
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Storage is a place where backups are uploaded to, listed and deleted from.
+type Storage interface {
+	// Put will store everything read from body under given key. Metadata is attached to the object where the
+	// backend supports it.
+	Put(key string, body io.Reader, metadata map[string]string) error
+	// Get will open the object stored under given key. It is the caller's responsibility to close it.
+	Get(key string) (io.ReadCloser, error)
+	// Copy will duplicate the object stored under src to dst without downloading it when possible.
+	Copy(src, dst string) error
+	// List will return all objects whose keys start with given prefix.
+	List(prefix string) ([]StoredObject, error)
+	// ListPrefixes will return the distinct prefixes of keys under given prefix up to the next slash, like
+	// directories. Prefix must be empty or end with a slash.
+	ListPrefixes(prefix string) ([]string, error)
+	// Delete will remove the object stored under given key.
+	Delete(key string) error
+	// DeleteAll will remove the objects stored under given keys, in batches where the backend supports it. Keys
+	// which could not be deleted are returned with their errors.
+	DeleteAll(keys []string) map[string]error
+	// AbortUploads will abort unfinished uploads of keys starting with given prefix, releasing the data they hold.
+	AbortUploads(prefix string) error
+}
+
+// newStorage will create the storage backend selected in configuration.
+func newStorage(config *Config) (Storage, error) {
+	switch config.Storage.Type {
+	case STORAGE_S3:
+		return newS3Storage(config)
+	case STORAGE_LOCAL:
+		return newLocalStorage(config.Storage.Path)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", config.Storage.Type)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStorage keeps backups in a directory on the local filesystem, e.g. a mounted NAS share.
+type localStorage struct {
+	root string
+}
+
+// newLocalStorage will create local storage rooted in given directory. The directory is created if missing.
+func newLocalStorage(root string) (*localStorage, error) {
+	if len(root) == 0 {
+		return nil, os.ErrInvalid
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{filepath.Clean(root)}, nil
+}
+
+// path will translate object key to path on the filesystem.
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put will write body into a file under the storage root. Metadata is not kept, everything needed to read the
+// backups back is part of the files themselves.
+func (s *localStorage) Put(key string, body io.Reader, metadata map[string]string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Get will open the file stored under given key.
+func (s *localStorage) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return file, err
+}
+
+// Copy will duplicate the file stored under src to dst.
+func (s *localStorage) Copy(src, dst string) error {
+	file, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.Put(dst, file, nil)
+}
+
+// List will walk the directory of given prefix and return all files whose keys start with it.
+func (s *localStorage) List(prefix string) ([]StoredObject, error) {
+	dir := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var objects []StoredObject
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StoredObject{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// ListPrefixes will return the directories in the directory of given prefix.
+func (s *localStorage) ListPrefixes(prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.path(prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			prefixes = append(prefixes, prefix+entry.Name()+"/")
+		}
+	}
+	return prefixes, nil
+}
+
+// Delete will remove the file and all parent directories which became empty.
+func (s *localStorage) Delete(key string) error {
+	path := s.path(key)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	for dir := filepath.Dir(path); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// AbortUploads does nothing, files are written in one go.
+func (s *localStorage) AbortUploads(prefix string) error {
+	return nil
+}
+
+// DeleteAll will remove the files stored under given keys one by one.
+func (s *localStorage) DeleteAll(keys []string) map[string]error {
+	failed := map[string]error{}
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			failed[key] = err
+		}
+	}
+	return failed
+}
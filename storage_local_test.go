@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(root)
+
+	storage, err := newLocalStorage(root)
+	checkErr(err)
+
+	checkErr(storage.Put("snapshot/org/repo.tar", strings.NewReader("mirror"), nil))
+	checkErr(storage.Put("snapshot/org/repo.issues.json", strings.NewReader("[]"), nil))
+	checkErr(storage.Put("other/file", strings.NewReader("other"), nil))
+
+	objects, err := storage.List("snapshot/")
+	checkErr(err)
+	if len(objects) != 2 {
+		t.Fatal("Wrong number of listed objects: ", objects)
+	}
+	if prefixes, _ := storage.ListPrefixes(""); strings.Join(prefixes, ",") != "other/,snapshot/" {
+		t.Fatal("Wrong prefixes listed: ", prefixes)
+	}
+
+	checkErr(storage.Delete("snapshot/org/repo.tar"))
+	if failed := storage.DeleteAll([]string{"snapshot/org/repo.issues.json", "missing"}); len(failed) != 1 ||
+		failed["missing"] == nil {
+		t.Fatal("Wrong keys failed to delete: ", failed)
+	}
+	if _, err := os.Stat(filepath.Join(root, "snapshot")); !os.IsNotExist(err) {
+		t.Fatal("Empty directories were not removed.")
+	}
+}
+
+func TestCleanupDeletesOldBackups(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(root)
+
+	storage, err := newLocalStorage(root)
+	checkErr(err)
+
+	old := RenderTime(time.Now().AddDate(0, 0, -10))
+	recent := RenderTime(time.Now().AddDate(0, 0, -1))
+	checkErr(storage.Put(old+"/org/repo.tar", strings.NewReader("old"), nil))
+	checkErr(storage.Put(recent+"/org/repo.tar", strings.NewReader("recent"), nil))
+
+	backup := &GithubBackup{config: &Config{KeepLastBackupDays: 7}, storage: storage, createdAt: RenderTime(time.Now())}
+	backup.cleanup()
+
+	objects, err := storage.List("")
+	checkErr(err)
+	if len(objects) != 1 || objects[0].Key != recent+"/org/repo.tar" {
+		t.Fatal("Wrong objects left after cleanup: ", objects)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// constants definitions of multipart upload and batch delete limits.
+const (
+	DEFAULT_S3_PART_SIZE_MB     = 16
+	DEFAULT_S3_PART_CONCURRENCY = 4
+	S3_MAX_PARTS                = 10000
+	S3_DELETE_BATCH_SIZE        = 1000
+)
+
+// s3Storage keeps backups in a S3 bucket.
+type s3Storage struct {
+	svc             *s3.S3
+	bucket          string
+	partSize        int64
+	partConcurrency int
+}
+
+// newS3Storage will create S3 storage for the bucket specified in configuration. Custom endpoint, path-style
+// addressing and CA bundle make it possible to use S3-compatible services such as MinIO or Ceph.
+func newS3Storage(config *Config) (*s3Storage, error) {
+	opts := session.Options{
+		Config: aws.Config{
+			HTTPClient:       &http.Client{}, // CA bundle is merged into the client, don't touch http.DefaultClient.
+			S3ForcePathStyle: aws.Bool(config.Storage.PathStyle),
+		},
+	}
+
+	if len(config.Storage.Endpoint) > 0 {
+		opts.Config.Endpoint = aws.String(config.Storage.Endpoint)
+	}
+
+	if len(config.Storage.CABundle) > 0 {
+		bundle, err := os.Open(config.Storage.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		defer bundle.Close()
+		opts.CustomCABundle = bundle
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	storage := &s3Storage{
+		svc: s3.New(sess), bucket: config.S3Bucket,
+		partSize: int64(config.Storage.PartSizeMB) * 1024 * 1024, partConcurrency: config.Storage.PartConcurrency,
+	}
+	if storage.partSize == 0 {
+		storage.partSize = DEFAULT_S3_PART_SIZE_MB * 1024 * 1024
+	}
+	if storage.partSize < S3_MIN_PART_SIZE {
+		return nil, fmt.Errorf("part size must be at least %d MB", S3_MIN_PART_SIZE/1024/1024)
+	}
+	if storage.partConcurrency <= 0 {
+		storage.partConcurrency = DEFAULT_S3_PART_CONCURRENCY
+	}
+	return storage, nil
+}
+
+// Put will upload body with a single PutObject if it is seekable and fits into one part, otherwise it is uploaded
+// using multipart upload. Metadata is stored as x-amz-meta-* headers.
+func (s *s3Storage) Put(key string, body io.Reader, metadata map[string]string) error {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if size <= s.partSize {
+			_, err := s.svc.PutObject(&s3.PutObjectInput{
+				Bucket: aws.String(s.bucket), Key: aws.String(key), Body: seeker, Metadata: aws.StringMap(metadata),
+			})
+			return err
+		}
+	}
+	return s.putMultipart(key, body, metadata)
+}
+
+// listUploads will find the unfinished multipart uploads of keys starting with prefix.
+func (s *s3Storage) listUploads(prefix string) ([]*s3.MultipartUpload, error) {
+	var uploads []*s3.MultipartUpload
+	params := &s3.ListMultipartUploadsInput{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)}
+	for {
+		resp, err := s.svc.ListMultipartUploads(params)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, resp.Uploads...)
+		if !aws.BoolValue(resp.IsTruncated) {
+			return uploads, nil
+		}
+		params.KeyMarker, params.UploadIdMarker = resp.NextKeyMarker, resp.NextUploadIdMarker
+	}
+}
+
+// AbortUploads will abort all unfinished multipart uploads of keys starting with prefix, so their parts are not
+// kept (and billed) forever.
+func (s *s3Storage) AbortUploads(prefix string) error {
+	uploads, err := s.listUploads(prefix)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := s.abort(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort will abort a single multipart upload.
+func (s *s3Storage) abort(upload *s3.MultipartUpload) error {
+	fmt.Printf("[~] Aborting unfinished upload of %s.\n", aws.StringValue(upload.Key))
+	_, err := s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket: aws.String(s.bucket), Key: upload.Key, UploadId: upload.UploadId,
+	})
+	return err
+}
+
+// resumableUpload will find the latest unfinished multipart upload of key and its uploaded parts, or start a new
+// upload if there is none. Encrypted data differs on every attempt, as every attempt gets a fresh data key and
+// nonce, so no uploaded part could ever be skipped; those uploads are aborted and started over instead.
+func (s *s3Storage) resumableUpload(key string, metadata map[string]string) (string, map[int64]*s3.Part, error) {
+	uploads, err := s.listUploads(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var latest *s3.MultipartUpload
+	for _, upload := range uploads {
+		if aws.StringValue(upload.Key) != key {
+			continue
+		}
+		if len(metadata[META_ENCRYPTION]) > 0 {
+			if err := s.abort(upload); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		if latest == nil || aws.TimeValue(upload.Initiated).After(aws.TimeValue(latest.Initiated)) {
+			latest = upload
+		}
+	}
+
+	if latest == nil {
+		upload, err := s.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(s.bucket), Key: aws.String(key), Metadata: aws.StringMap(metadata),
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return aws.StringValue(upload.UploadId), map[int64]*s3.Part{}, nil
+	}
+
+	uploaded := map[int64]*s3.Part{}
+	partsParams := &s3.ListPartsInput{Bucket: aws.String(s.bucket), Key: aws.String(key), UploadId: latest.UploadId}
+	for {
+		resp, err := s.svc.ListParts(partsParams)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, part := range resp.Parts {
+			uploaded[aws.Int64Value(part.PartNumber)] = part
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		partsParams.PartNumberMarker = resp.NextPartNumberMarker
+	}
+
+	fmt.Printf("[+] Resuming upload of %s, %d parts already uploaded.\n", key, len(uploaded))
+	return aws.StringValue(latest.UploadId), uploaded, nil
+}
+
+// uploadPart will upload a single part unless the same data was uploaded by an interrupted attempt already, which
+// is recognised by the part size and its MD5 ETag.
+func (s *s3Storage) uploadPart(key, uploadId string, partNumber int64, data []byte, uploaded *s3.Part) (*s3.CompletedPart, error) {
+	sum := md5.Sum(data)
+	etag := fmt.Sprintf("\"%x\"", sum)
+	if uploaded != nil && aws.Int64Value(uploaded.Size) == int64(len(data)) && aws.StringValue(uploaded.ETag) == etag {
+		return &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int64(partNumber)}, nil
+	}
+
+	part, err := s.svc.UploadPart(&s3.UploadPartInput{
+		Bucket: aws.String(s.bucket), Key: aws.String(key), UploadId: aws.String(uploadId),
+		PartNumber: aws.Int64(partNumber), Body: bytes.NewReader(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(partNumber)}, nil
+}
+
+// putMultipart will upload data read from body using multipart upload with the configured number of parts in
+// flight, so at most that many parts are buffered in memory. Failed uploads are not aborted, the next retry of the
+// same key resumes them and skips the parts which were uploaded already. Keys contain the snapshot, so uploads left
+// over at the end of a run are aborted by the run itself (see AbortUploads).
+func (s *s3Storage) putMultipart(key string, body io.Reader, metadata map[string]string) error {
+	uploadId, uploaded, err := s.resumableUpload(key, metadata)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []*s3.CompletedPart
+		firstErr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	inFlight := make(chan struct{}, s.partConcurrency)
+
+	for partNumber := int64(1); !failed(); partNumber++ {
+		if partNumber > S3_MAX_PARTS {
+			mu.Lock()
+			firstErr = fmt.Errorf("%s has more than %d parts, increase part_size_mb", key, S3_MAX_PARTS)
+			mu.Unlock()
+			break
+		}
+
+		inFlight <- struct{}{}
+		buf := make([]byte, s.partSize)
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			<-inFlight
+			mu.Lock()
+			firstErr = readErr
+			mu.Unlock()
+			break
+		}
+
+		if n > 0 || partNumber == 1 {
+			wg.Add(1)
+			go func(partNumber int64, data []byte) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+
+				part, err := s.uploadPart(key, uploadId, partNumber, data, uploaded[partNumber])
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					return
+				}
+				parts = append(parts, part)
+			}(partNumber, buf[:n])
+		} else {
+			<-inFlight
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+	_, err = s.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: aws.String(s.bucket), Key: aws.String(key), UploadId: aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// Get will download the object from the bucket.
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	output, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket), Key: aws.String(key),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// Copy will duplicate the object server-side, so no data has to be transferred by the backup.
+func (s *s3Storage) Copy(src, dst string) error {
+	_, err := s.svc.CopyObject(&s3.CopyObjectInput{
+		Bucket: aws.String(s.bucket), Key: aws.String(dst),
+		CopySource: aws.String(copySource(s.bucket, src)),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// copySource will build URL-encoded x-amz-copy-source value, keeping the slashes between key segments.
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// List will return all objects whose keys start with given prefix, paging through ListObjectsV2 with continuation
+// tokens.
+func (s *s3Storage) List(prefix string) ([]StoredObject, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket), Prefix: aws.String(prefix),
+	}
+
+	var objects []StoredObject
+	err := s.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, StoredObject{
+				Key: aws.StringValue(obj.Key), Size: aws.Int64Value(obj.Size), LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// ListPrefixes will return the common prefixes of keys under given prefix delimited by a slash.
+func (s *s3Storage) ListPrefixes(prefix string) ([]string, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket), Prefix: aws.String(prefix), Delimiter: aws.String("/"),
+	}
+
+	var prefixes []string
+	err := s.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, common := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(common.Prefix))
+		}
+		return true
+	})
+	return prefixes, err
+}
+
+// Delete will remove a single object from the bucket.
+func (s *s3Storage) Delete(key string) error {
+	output, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket), Key: aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[+/!] S3 Delete Object executed: %s\n", output)
+	return nil
+}
+
+// DeleteAll will remove objects in batches of up to S3_DELETE_BATCH_SIZE keys with DeleteObjects. A failed request
+// fails all keys of its batch.
+func (s *s3Storage) DeleteAll(keys []string) map[string]error {
+	failed := map[string]error{}
+	for start := 0; start < len(keys); start += S3_DELETE_BATCH_SIZE {
+		end := start + S3_DELETE_BATCH_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		output, err := s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket), Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, key := range keys[start:end] {
+				failed[key] = err
+			}
+			continue
+		}
+		for _, e := range output.Errors {
+			failed[aws.StringValue(e.Key)] = fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
+	}
+
+	fmt.Printf("[+] S3 deleted %d of %d objects.\n", len(keys)-len(failed), len(keys))
+	return failed
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory S3-compatible server with path-style addressing, used as a stand-in for MinIO.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	pageSize int
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	uploads  map[string]map[int][]byte
+
+	uploadKeys  map[string]string // upload id to key of unfinished multipart uploads
+	partUploads map[int]int       // number of uploads of each part number
+	failPart    int               // part number uploads of which fail
+
+	deleteBatches []int           // number of keys of each DeleteObjects request
+	failDelete    map[string]bool // keys DeleteObjects fails to delete
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, pageSize: 2, objects: map[string][]byte{}, metadata: map[string]map[string]string{},
+		uploads: map[string]map[int][]byte{}, uploadKeys: map[string]string{}, partUploads: map[int]int{}}
+}
+
+type fakeS3Object struct {
+	Key          string
+	Size         int64
+	LastModified string
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Object
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+type fakeS3DeleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type fakeS3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type fakeS3DeleteResult struct {
+	XMLName xml.Name            `xml:"DeleteResult"`
+	Error   []fakeS3DeleteError `xml:"Error"`
+}
+
+type fakeS3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	UploadId string
+}
+
+type fakeS3Upload struct {
+	Key       string
+	UploadId  string
+	Initiated string
+}
+
+type fakeS3UploadsResult struct {
+	XMLName xml.Name       `xml:"ListMultipartUploadsResult"`
+	Upload  []fakeS3Upload `xml:"Upload"`
+}
+
+type fakeS3Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+type fakeS3PartsResult struct {
+	XMLName xml.Name     `xml:"ListPartsResult"`
+	Part    []fakeS3Part `xml:"Part"`
+}
+
+type fakeS3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int
+	} `xml:"Part"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != f.bucket && !strings.HasPrefix(path, f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, f.bucket), "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "GET" && query["uploads"] != nil:
+		var result fakeS3UploadsResult
+		for uploadId, uploadKey := range f.uploadKeys {
+			if strings.HasPrefix(uploadKey, query.Get("prefix")) {
+				result.Upload = append(result.Upload, fakeS3Upload{
+					Key: uploadKey, UploadId: uploadId, Initiated: time.Now().UTC().Format(time.RFC3339),
+				})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && query.Get("uploadId") != "":
+		var result fakeS3PartsResult
+		for part, data := range f.uploads[query.Get("uploadId")] {
+			result.Part = append(result.Part, fakeS3Part{PartNumber: part, ETag: etag(data), Size: int64(len(data))})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET" && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token"))
+	case r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			f.notFound(w)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		f.partUploads[part]++
+		if part == f.failPart {
+			http.Error(w, "InvalidRequest", http.StatusBadRequest)
+			return
+		}
+		f.uploads[query.Get("uploadId")][part] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		data, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+		if !ok {
+			f.notFound(w)
+			return
+		}
+		f.objects[key] = data
+		w.Write([]byte("<CopyObjectResult></CopyObjectResult>"))
+	case r.Method == "PUT":
+		f.objects[key] = body
+		f.storeMetadata(key, r.Header)
+	case r.Method == "POST" && query["delete"] != nil:
+		var request fakeS3DeleteRequest
+		xml.Unmarshal(body, &request)
+		f.deleteBatches = append(f.deleteBatches, len(request.Objects))
+		var result fakeS3DeleteResult
+		for _, obj := range request.Objects {
+			if f.failDelete[obj.Key] {
+				result.Error = append(result.Error, fakeS3DeleteError{obj.Key, "AccessDenied", "Access Denied"})
+				continue
+			}
+			delete(f.objects, obj.Key)
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "POST" && query["uploads"] != nil:
+		f.storeMetadata(key, r.Header)
+		uploadId := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[uploadId] = map[int][]byte{}
+		f.uploadKeys[uploadId] = key
+		xml.NewEncoder(w).Encode(fakeS3InitiateResult{UploadId: uploadId})
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		var complete fakeS3CompleteRequest
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		delete(f.uploadKeys, query.Get("uploadId"))
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		delete(f.uploadKeys, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// etag will compute S3 ETag of an object or a part uploaded at once.
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+// storeMetadata will keep x-amz-meta-* headers of an object.
+func (f *fakeS3) storeMetadata(key string, header http.Header) {
+	metadata := map[string]string{}
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"))] = header.Get(name)
+		}
+	}
+	f.metadata[key] = metadata
+}
+
+func (f *fakeS3) notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter, token string) {
+	// keys and common prefixes are paged together in lexical order, the token is the last entry of the previous page
+	prefixes := map[string]bool{}
+	var entries []string
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); len(delimiter) > 0 && i >= 0 {
+			key = key[:len(prefix)+i+len(delimiter)]
+			if prefixes[key] {
+				continue
+			}
+			prefixes[key] = true
+		}
+		if key > token {
+			entries = append(entries, key)
+		}
+	}
+	sort.Strings(entries)
+
+	var result fakeS3ListResult
+	if len(entries) > f.pageSize {
+		entries, result.IsTruncated = entries[:f.pageSize], true
+		result.NextContinuationToken = entries[len(entries)-1]
+	}
+	for _, entry := range entries {
+		if prefixes[entry] {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{entry})
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Object{
+			Key: entry, Size: int64(len(f.objects[entry])), LastModified: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// newFakeS3Storage will start the fake S3 server over TLS and connect S3 storage to it through a custom endpoint,
+// path-style addressing and a CA bundle holding the server certificate.
+func newFakeS3Storage(t *testing.T) (*fakeS3, *s3Storage, func()) {
+	fake := newFakeS3("backups")
+	server := httptest.NewTLSServer(fake)
+
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	bundle := filepath.Join(dir, "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	checkErr(ioutil.WriteFile(bundle, pemData, 0644))
+
+	// restored once the test is done, later tests must not see the credentials of the fake
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	config := &Config{S3Bucket: "backups", Storage: StorageConfig{
+		Type: STORAGE_S3, Endpoint: server.URL, PathStyle: true, CABundle: bundle,
+	}}
+	storage, err := newS3Storage(config)
+	if err != nil {
+		t.Fatal("Creating S3 storage failed: ", err)
+	}
+
+	return fake, storage, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestS3CompatibleStorage(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+
+	checkErr(storage.Put("snapshot/org/repo.tar", bytes.NewReader([]byte("mirror")), nil))
+
+	large := bytes.Repeat([]byte("x"), S3_MIN_PART_SIZE+1024)
+	checkErr(storage.Put("snapshot/org/repo/releases/v1/asset.bin", bytes.NewBuffer(large), nil))
+	if !bytes.Equal(fake.objects["snapshot/org/repo/releases/v1/asset.bin"], large) {
+		t.Fatal("Streamed multipart upload was not assembled correctly.")
+	}
+
+	checkErr(storage.Put("snapshot/org/repo.issues.json", strings.NewReader("[]"), nil))
+	objects, err := storage.List("snapshot/")
+	checkErr(err)
+	if len(objects) != 3 {
+		t.Fatal("Wrong number of listed objects: ", objects)
+	}
+
+	checkErr(storage.Copy("snapshot/org/repo.tar", "next:snapshot/org/repo.tar"))
+	body, err := storage.Get("next:snapshot/org/repo.tar")
+	checkErr(err)
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "mirror" {
+		t.Fatal("Copied object has wrong content: ", string(data))
+	}
+
+	checkErr(storage.Delete("snapshot/org/repo.tar"))
+	if _, ok := fake.objects["snapshot/org/repo.tar"]; ok {
+		t.Fatal("Object was not deleted.")
+	}
+	if _, err := storage.Get("snapshot/org/repo.tar"); err != errObjectNotFound {
+		t.Fatal("Missing object was not reported: ", err)
+	}
+}
+
+func TestCleanupOnS3CompatibleStorage(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+
+	// an empty bucket must not break the cleanup
+	empty := &GithubBackup{config: &Config{KeepLastBackupDays: 7}, storage: storage, createdAt: RenderTime(time.Now())}
+	empty.cleanup()
+	if err := empty.report.err(); err != nil {
+		t.Fatal("Cleanup of empty bucket failed: ", err)
+	}
+
+	old := RenderTime(time.Now().AddDate(0, 0, -10))
+	recent := RenderTime(time.Now().AddDate(0, 0, -1))
+	for _, repo := range []string{"a", "b", "c"} {
+		checkErr(storage.Put(old+"/org/"+repo+".tar", strings.NewReader("old"), nil))
+		checkErr(storage.Put(recent+"/org/"+repo+".tar", strings.NewReader("recent"), nil))
+	}
+
+	backup := &GithubBackup{config: &Config{KeepLastBackupDays: 7}, storage: storage, createdAt: RenderTime(time.Now())}
+	backup.cleanup()
+
+	if len(fake.objects) != 3 {
+		t.Fatal("Wrong objects left after cleanup: ", len(fake.objects))
+	}
+	for key := range fake.objects {
+		if !strings.HasPrefix(key, recent) {
+			t.Fatal("Recent backup was deleted: ", key)
+		}
+	}
+}
+
+func TestResumeMultipartUpload(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+	storage.partSize = S3_MIN_PART_SIZE
+
+	data := make([]byte, 3*S3_MIN_PART_SIZE+1024)
+	for i := range data {
+		data[i] = byte(i / S3_MIN_PART_SIZE)
+	}
+
+	fake.failPart = 3
+	if err := storage.Put("snapshot/org/repo.tar", bytes.NewBuffer(data), nil); err == nil {
+		t.Fatal("Failing part did not fail the upload.")
+	}
+	if len(fake.uploadKeys) != 1 {
+		t.Fatal("Interrupted upload was not kept for resuming: ", fake.uploadKeys)
+	}
+
+	fake.failPart = 0
+	checkErr(storage.Put("snapshot/org/repo.tar", bytes.NewReader(data), nil))
+
+	if !bytes.Equal(fake.objects["snapshot/org/repo.tar"], data) {
+		t.Fatal("Resumed upload was not assembled correctly.")
+	}
+	if fake.partUploads[1] != 1 || fake.partUploads[2] != 1 || fake.partUploads[3] != 2 {
+		t.Fatal("Uploaded parts were not skipped: ", fake.partUploads)
+	}
+	if len(fake.uploadKeys) != 0 {
+		t.Fatal("Multipart upload was left unfinished: ", fake.uploadKeys)
+	}
+}
+
+func TestAbortUnfinishedUploads(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+	storage.partSize = S3_MIN_PART_SIZE
+	data := bytes.Repeat([]byte("x"), 3*S3_MIN_PART_SIZE)
+	encrypted := map[string]string{META_ENCRYPTION: ENCRYPTION_ALGORITHM}
+
+	// encrypted data differs on every attempt, a retry starts over and drops the parts of the failed attempt
+	fake.failPart = 3
+	if err := storage.Put("snapshot/org/repo.tar", bytes.NewBuffer(data), encrypted); err == nil {
+		t.Fatal("Failing part did not fail the upload.")
+	}
+	if err := storage.Put("snapshot/org/repo.tar", bytes.NewBuffer(data), encrypted); err == nil {
+		t.Fatal("Failing part did not fail the upload.")
+	}
+	if len(fake.uploadKeys) != 1 || fake.partUploads[1] != 2 {
+		t.Fatal("Encrypted upload was resumed: ", fake.uploadKeys, fake.partUploads)
+	}
+
+	checkErr(storage.AbortUploads("other/"))
+	if len(fake.uploadKeys) != 1 {
+		t.Fatal("Upload of another snapshot was aborted.")
+	}
+	checkErr(storage.AbortUploads("snapshot/"))
+	if len(fake.uploadKeys) != 0 {
+		t.Fatal("Unfinished upload was not aborted: ", fake.uploadKeys)
+	}
+}
+
+func TestS3BatchDelete(t *testing.T) {
+	fake, storage, done := newFakeS3Storage(t)
+	defer done()
+
+	fake.pageSize = 1000
+	snapshot := RenderTime(time.Now().AddDate(0, 0, -30))
+	for i := 0; i < 2500; i++ {
+		fake.objects[fmt.Sprintf("%s/org/repo-%04d.tar", snapshot, i)] = []byte("old")
+	}
+	fake.objects["state/org/repo.json"] = []byte("{}")
+	fake.objects["notes.txt"] = []byte("keep")
+	denied := snapshot + "/org/repo-1234.tar"
+	fake.failDelete = map[string]bool{denied: true}
+
+	backup := &GithubBackup{config: &Config{Retry: RetryConfig{Storage: RetryPolicy{Attempts: 2}}}, storage: storage}
+	objects, err := backup.listSnapshotObjects()
+	checkErr(err)
+	snapshots, _ := groupSnapshots(objects)
+	if len(snapshots) != 1 || len(snapshots[0].Objects) != 2500 {
+		t.Fatal("Snapshot was not listed page by page: ", len(objects))
+	}
+
+	backup.prune(snapshots[0])
+
+	if len(fake.deleteBatches) != 4 || fake.deleteBatches[0] != S3_DELETE_BATCH_SIZE || fake.deleteBatches[2] != 500 ||
+		fake.deleteBatches[3] != 1 {
+		t.Fatal("Objects were not deleted in batches: ", fake.deleteBatches)
+	}
+	if len(fake.objects) != 3 || fake.objects[denied] == nil {
+		t.Fatal("Wrong objects left after prune: ", len(fake.objects))
+	}
+	if len(backup.report.failures) != 1 || backup.report.failures[0].Name != denied ||
+		!strings.Contains(backup.report.failures[0].Err.Error(), "AccessDenied") {
+		t.Fatal("Failed key was not reported: ", backup.report.failures)
+	}
+}
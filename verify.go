@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// verifyOptions selects the snapshot and the repositories to verify.
+type verifyOptions struct {
+	Snapshot     string
+	Organisation string
+	Pattern      string
+	Sample       float64
+}
+
+// runVerify is the entry point of the verify subcommand.
+func runVerify(args []string) {
+	var opts verifyOptions
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&opts.Snapshot, "snapshot", "", "timestamp of the snapshot to verify, e.g. "+DATETIME_LAYOUT)
+	flags.StringVar(&opts.Organisation, "org", "", "organisation to verify repositories of, all if empty")
+	flags.StringVar(&opts.Pattern, "repo", "*", "glob pattern of repository names to verify")
+	flags.Float64Var(&opts.Sample, "sample", 100, "percentage of matching repositories to verify, chosen randomly")
+	flags.Parse(args)
+
+	if _, err := ParseTime(opts.Snapshot); err != nil || opts.Sample <= 0 || opts.Sample > 100 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := NewGithubBackup().verify(&opts); err != nil {
+		fmt.Println("[!] verify failed: ", err)
+		os.Exit(1)
+	}
+}
+
+// sampleRepositories will select repositories of the manifest matching the options. When sampling, a random share
+// of them is taken, at least one.
+func sampleRepositories(manifest *snapshotManifest, opts *verifyOptions) []*manifestRepository {
+	var repos []*manifestRepository
+	for _, repo := range manifest.Repositories {
+		if len(opts.Organisation) > 0 && repo.Organisation != opts.Organisation {
+			continue
+		}
+		if matched, err := filepath.Match(opts.Pattern, repo.Name); err != nil || !matched {
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	if opts.Sample >= 100 || len(repos) == 0 {
+		return repos
+	}
+
+	rand.Shuffle(len(repos), func(i, j int) { repos[i], repos[j] = repos[j], repos[i] })
+	repos = repos[:int(math.Ceil(float64(len(repos))*opts.Sample/100))]
+	sort.Slice(repos, func(i, j int) bool {
+		a, b := repos[i], repos[j]
+		return a.Organisation < b.Organisation || (a.Organisation == b.Organisation && a.Name < b.Name)
+	})
+	return repos
+}
+
+// verify will check that repositories of a snapshot can be restored. Failures are reported per repository.
+func (app *GithubBackup) verify(opts *verifyOptions) error {
+	manifest, err := app.loadManifest(opts.Snapshot)
+	if err == errObjectNotFound {
+		return fmt.Errorf("snapshot %s has no manifest to verify against", opts.Snapshot)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read manifest of snapshot %s: %s", opts.Snapshot, err)
+	}
+	if !manifest.Complete {
+		fmt.Printf("[!] snapshot %s is incomplete, the backup did not finish or some repositories failed.\n", opts.Snapshot)
+	}
+
+	repos := sampleRepositories(manifest, opts)
+	if len(repos) == 0 {
+		return fmt.Errorf("no repositories matching %q found in snapshot %s", opts.Pattern, opts.Snapshot)
+	}
+
+	fmt.Printf("[+] Verifying %d repositories of snapshot %s.\n", len(repos), opts.Snapshot)
+	for _, repo := range repos {
+		app.verifyRepository(opts.Snapshot, repo)
+	}
+
+	app.report.printSummary(os.Stdout)
+	if app.report.err() != nil {
+		return fmt.Errorf("snapshot %s did not pass verification", opts.Snapshot)
+	}
+	return nil
+}
+
+// verifyRepository will download all artifacts of a repository checking them against the manifest, unpack its
+// mirrors and check them with git fsck. Failures are recorded in the run report.
+func (app *GithubBackup) verifyRepository(snapshot string, repo *manifestRepository) {
+	defer app.report.processed()
+
+	name := repo.Organisation + "/" + repo.Name
+	fmt.Printf("[+] Verifying %s.\n", name)
+	if repo.Status != STATUS_OK {
+		fmt.Printf("[~] backup of %s failed: %s\n", name, strings.Join(repo.Errors, "; "))
+	}
+	if repo.Status == STATUS_OK && len(repo.Artifacts) == 0 && len(repo.Refs) == 0 {
+		fmt.Printf("[~] %s is empty, nothing to verify.\n", name)
+		return
+	}
+
+	tmpDir, err := ioutil.TempDir("", "ghbackup-verify")
+	if err != nil {
+		app.report.fail(name, inPhase(PHASE_UNPACK, err))
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// artifacts are downloaded once into a local storage, the mirrors are unpacked from there
+	local, err := newLocalStorage(filepath.Join(tmpDir, "objects"))
+	if err != nil {
+		app.report.fail(name, inPhase(PHASE_UNPACK, err))
+		return
+	}
+
+	var keys []string
+	corrupted := map[string]bool{}
+	for _, artifact := range repo.Artifacts {
+		keys = append(keys, artifact.Key)
+		if err := app.fetchArtifact(artifact, local); err != nil {
+			app.report.fail(artifact.Key, inPhase(PHASE_CHECKSUM, err))
+			corrupted[artifact.Key] = true
+		}
+	}
+
+	mirrors := groupArtifacts(fmt.Sprintf("%s/%s/", snapshot, repo.Organisation), keys, "*")
+	if mirrors[repo.Name] == nil {
+		app.report.fail(name, inPhase(PHASE_UNPACK, errors.New("no mirror was backed up")))
+	}
+
+	offline := &GithubBackup{config: app.config, storage: local, keys: app.keys}
+	for mirror, artifacts := range mirrors {
+		label := name
+		if mirror != repo.Name {
+			label = name + " (wiki)"
+		} else {
+			artifacts.Refs = repo.Refs
+		}
+		if corrupted[artifacts.Tarball] || anyOf(artifacts.Bundles, corrupted) {
+			continue // already reported
+		}
+
+		refs, err := offline.verifyMirror(mirror, artifacts, filepath.Join(tmpDir, "mirrors"))
+		if err != nil {
+			app.report.fail(label, err)
+			continue
+		}
+		if mirror == repo.Name && repo.Refs != nil && len(refs) != len(repo.Refs) {
+			app.report.fail(label, inPhase(PHASE_FSCK,
+				fmt.Errorf("mirror has %d refs, the backup recorded %d", len(refs), len(repo.Refs))))
+		}
+	}
+}
+
+// anyOf will check whether any of the keys is in the set.
+func anyOf(keys []string, set map[string]bool) bool {
+	for _, key := range keys {
+		if set[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchArtifact will copy an artifact into the local storage and compare its size and digest with the manifest.
+func (app *GithubBackup) fetchArtifact(artifact manifestArtifact, local Storage) error {
+	var fetched manifestArtifact
+	err := app.retry(app.config.Retry.Storage, artifact.Key, func() error {
+		body, err := app.storage.Get(artifact.Key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		digest := newDigestReader(body)
+		if err := local.Put(artifact.Key, digest, nil); err != nil {
+			return err
+		}
+		fetched = digest.artifact(artifact.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(artifact.SHA256) == 0 {
+		fmt.Printf("[~] no checksum of %s was recorded.\n", artifact.Key)
+		return nil
+	}
+	if fetched.Size != artifact.Size || fetched.SHA256 != artifact.SHA256 {
+		return fmt.Errorf("stored object has %d bytes with sha256 %s, the manifest records %d bytes with sha256 %s",
+			fetched.Size, fetched.SHA256, artifact.Size, artifact.SHA256)
+	}
+	return nil
+}
+
+// verifyMirror will unpack a bare mirror into dir, check it with git fsck and return its refs.
+func (app *GithubBackup) verifyMirror(mirror string, artifacts *restoreArtifacts, dir string) (map[string]string, error) {
+	repoPath := filepath.Join(dir, mirror)
+
+	var err error
+	if len(artifacts.Bundles) > 0 {
+		err = app.unpackBundles(artifacts.Bundles, artifacts.Refs, repoPath)
+	} else {
+		err = app.unpackTarball(artifacts.Tarball, dir)
+	}
+	if err != nil {
+		return nil, inPhase(PHASE_UNPACK, err)
+	}
+
+	if output, err := exec.Command("git", "-C", repoPath, "fsck", "--full", "--no-progress").CombinedOutput(); err != nil {
+		return nil, inPhase(PHASE_FSCK, fmt.Errorf("git fsck: %s: %s", err, strings.TrimSpace(string(output))))
+	}
+	refs, err := listRefs(repoPath)
+	if err != nil {
+		return nil, inPhase(PHASE_FSCK, fmt.Errorf("cannot list refs: %s", err))
+	}
+	return refs, nil
+}
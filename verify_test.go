@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	checkErr(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	storage, err := newLocalStorage("storage")
+	checkErr(err)
+	snapshot := RenderTime(time.Now())
+	backup := &GithubBackup{config: &Config{Format: FORMAT_BUNDLE, BundleFullEvery: 7, Compression: COMPRESSION_GZIP},
+		storage: storage, createdAt: snapshot}
+	backup.manifest = newManifestRecorder(snapshot)
+
+	git(t, ".", "init", "-q", "origin")
+	git(t, "origin", "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, "origin", "tag", "v1")
+
+	for _, repo := range []string{"tarred", "bundled", "corrupted", "lost"} {
+		repoPath := snapshot + "/org/" + repo
+		git(t, ".", "clone", "-q", "--mirror", "origin", repoPath)
+		refs, err := listRefs(repoPath)
+		checkErr(err)
+		backup.manifest.refs(repoPath, refs)
+
+		if repo == "bundled" {
+			_, err = backup.uploadBundle(nil, repoPath, refs, nil)
+		} else {
+			err = backup.archive(repoPath, repoPath+".tar.gz")
+		}
+		checkErr(err)
+		backup.manifest.finish(repoPath, nil)
+	}
+	checkErr(backup.writeManifest(true))
+
+	// a tag lost after the backup recorded it, and an archive damaged in the storage
+	backup.manifest.refs(snapshot+"/org/lost", map[string]string{"refs/heads/master": "a", "refs/tags/v1": "b", "refs/tags/v2": "c"})
+	checkErr(backup.writeManifest(true))
+	checkErr(ioutil.WriteFile(filepath.Join("storage", snapshot, "org", "corrupted.tar.gz"), []byte("garbage"), 0644))
+
+	opts := &verifyOptions{Snapshot: snapshot, Organisation: "org", Pattern: "*", Sample: 100}
+	if err := backup.verify(opts); err == nil {
+		t.Fatal("Damaged snapshot passed verification.")
+	}
+
+	failed := map[string]string{}
+	for _, failure := range backup.report.failures {
+		failed[failure.Name] = failure.Phase
+	}
+	if len(failed) != 2 || failed[snapshot+"/org/corrupted.tar.gz"] != PHASE_CHECKSUM || failed["org/lost"] != PHASE_FSCK {
+		t.Fatal("Wrong failures reported: ", failed)
+	}
+
+	backup.report = runReport{}
+	opts.Pattern = "*ed"
+	opts.Sample = 50
+	output := captureStdout(func() {
+		if err := backup.verify(opts); err != nil && !strings.Contains(err.Error(), "did not pass") {
+			t.Fatal("Verification failed: ", err)
+		}
+	})
+	if !strings.Contains(output, "Verifying 2 repositories") {
+		t.Fatal("Repositories were not sampled: ", output)
+	}
+}
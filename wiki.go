@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// wikiCloneURL will derive the clone URL of the wiki belonging to a repository from the repository clone URL.
+func wikiCloneURL(cloneUrl string) string {
+	return strings.TrimSuffix(cloneUrl, ".git") + ".wiki.git"
+}
+
+// backupWiki will mirror the wiki of a repository and upload it as <repo>.wiki.tar(.gz|.zst) next to the repository tarball.
+// Repositories with enabled but never initialised wiki are skipped. GitHub answers "not found" for both a missing
+// wiki and rejected credentials, so a missing wiki is only trusted when the repository itself was reached with the
+// same credentials, i.e. repoReached is set.
+func (app *GithubBackup) backupWiki(repo *github.Repository, repoPath string, repoReached bool) error {
+	if !repo.GetHasWiki() {
+		return nil
+	}
+
+	wikiPath := fmt.Sprintf("%s.wiki", repoPath)
+	err := app.mirror(*repo.Owner.Login, *repo.FullName+" (wiki)", wikiCloneURL(app.cloneURL(repo)), wikiPath)
+	if err == errRemoteNotFound && repoReached {
+		fmt.Printf("[+] Wiki of %s is not initialised, skipping.\n", *repo.FullName)
+		return nil
+	}
+	if err == errRemoteNotFound {
+		return inPhase(PHASE_CLONE, errors.New("wiki not found and the repository could not be cloned either, access may have been denied"))
+	}
+	if err != nil {
+		return inPhase(PHASE_CLONE, err)
+	}
+
+	defer os.RemoveAll(wikiPath)
+	return app.archive(wikiPath, wikiPath+archiveExtension(app.config.Compression))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestWikiCloneURL(t *testing.T) {
+	url := wikiCloneURL("https://github.com/camunda/camunda-bpm-platform.git")
+	if url != "https://github.com/camunda/camunda-bpm-platform.wiki.git" {
+		t.Fatal("Wrong wiki clone url: ", url)
+	}
+
+	url = wikiCloneURL("git@github.com:camunda/camunda-bpm-platform.git")
+	if url != "git@github.com:camunda/camunda-bpm-platform.wiki.git" {
+		t.Fatal("Wrong wiki SSH url: ", url)
+	}
+}
+
+func TestWikiNotFoundIsOnlySkippedForReachedRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghbackup")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	git(t, dir, "init", "-q", "--bare", "remote/camunda/repo.git")
+	server := fakeGitServer(t, filepath.Join(dir, "remote"), "backup", "secret")
+	defer server.Close()
+
+	repo := &github.Repository{
+		FullName: github.String("camunda/repo"),
+		Owner:    &github.User{Login: github.String("camunda")},
+		CloneURL: github.String(server.URL + "/camunda/repo.git"),
+		HasWiki:  github.Bool(true),
+	}
+	backup := &GithubBackup{config: &Config{GithubAuth: AUTH_TOKEN, Username: "backup", Token: "secret"}}
+	repoPath := filepath.Join(dir, "backup", "repo")
+
+	if err := backup.backupWiki(repo, repoPath, true); err != nil {
+		t.Fatal("Missing wiki of a reached repository was not skipped: ", err)
+	}
+
+	err = backup.backupWiki(repo, repoPath, false)
+	if err == nil || !strings.Contains(err.Error(), "wiki not found") {
+		t.Fatal("Missing wiki of an unreachable repository was not reported: ", err)
+	}
+}